@@ -0,0 +1,2075 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JetStreamStoreDir is the top level directory name used for JetStream
+// storage, and doubles as the TempDir prefix used by the tests in this
+// package.
+const JetStreamStoreDir = "jetstream"
+
+// On disk layout constants for a FileStore.
+const (
+	// msgDir is the directory, relative to FileStoreConfig.StoreDir, that
+	// holds the message blocks and their indexes.
+	msgDir = "msgs"
+	// blkScan is the filename pattern for a message block file.
+	blkScan = "%d.blk"
+	// idxScan is the filename pattern for a message block's index file.
+	idxScan = "%d.idx"
+	// blkSumScan is the filename pattern for a message block's trailer,
+	// written on flush/rotate with that block's rolling CRC.
+	blkSumScan = "%d.sum"
+	// storeMetaFile holds a small amount of state (first/last sequence)
+	// that can not always be derived purely from the blocks on disk, e.g.
+	// right after a Purge leaves no live messages behind.
+	storeMetaFile = "meta.inf"
+	// dedupIndexFile holds the store-wide content-addressed payload index
+	// used when FileStoreConfig.Dedup is enabled. Unlike a block's .idx
+	// file, it lives directly under StoreDir since it is not scoped to a
+	// single block.
+	dedupIndexFile = "dedup.idx"
+	// dirtyMarkerFile exists on disk for as long as a store is open. Its
+	// presence when newFileStore runs means the previous run never
+	// reached Stop to remove it - an unclean shutdown - which triggers
+	// an automatic Repair(RepairQuarantine) pass before the store opens.
+	dirtyMarkerFile = "dirty.lock"
+
+	// defaultBlockSize is used when FileStoreConfig.BlockSize is not set.
+	defaultBlockSize = 16 * 1024 * 1024
+)
+
+// snapshotManifestFile is the name of the JSON entry Snapshot writes first
+// in its tar stream, and the only entry name RestoreSnapshot will accept
+// as the stream's first entry.
+const snapshotManifestFile = "manifest.json"
+
+// snapshotVersion is bumped whenever the Snapshot/RestoreSnapshot tar
+// layout or manifest fields below change in an incompatible way.
+const snapshotVersion = 1
+
+// Message record layout on disk:
+//
+//	[4]  total record length (includes header, subject, msg and trailer)
+//	[8]  sequence number (0 once erased/removed)
+//	[8]  timestamp, UnixNano (0 once erased/removed)
+//	[1]  flags (msgFlagHashRef set when the body is a dedup hash, not payload)
+//	[2]  subject length
+//	[N]  subject bytes
+//	[M]  msg bytes, or a dedupHashSize hash when msgFlagHashRef is set
+//	[4]  crc32 (IEEE) over everything preceding it
+const (
+	msgHdrSize    = 4 + 8 + 8 + 1 + 2
+	msgTrailerLen = 4
+)
+
+// msgFlagHashRef marks a message record whose body holds a content hash
+// (see FileStoreConfig.Dedup) rather than the message payload itself.
+const msgFlagHashRef uint8 = 1 << 0
+
+// dedupHashSize is the width of the content hash FileStoreConfig.Dedup
+// indexes payloads by.
+const dedupHashSize = sha256.Size
+
+// StorageType determines how messages are stored for retention.
+type StorageType int
+
+const (
+	// MemoryStorage specifies in memory only.
+	MemoryStorage StorageType = iota
+	// FileStorage specifies on disk, designated by FileStoreConfig.StoreDir.
+	FileStorage
+)
+
+// MsgSetConfig describes the message set (stream) that a store backs.
+type MsgSetConfig struct {
+	Name     string
+	Storage  StorageType
+	MaxMsgs  int64
+	MaxBytes int64
+	MaxAge   time.Duration
+}
+
+// FileStoreConfig is the file system based storage configuration.
+type FileStoreConfig struct {
+	// StoreDir is the directory that will hold the message blocks and
+	// their indexes for this store.
+	StoreDir string
+	// BlockSize is the maximum size in bytes a given message block will
+	// grow to before a new one is rotated in.
+	BlockSize uint64
+	// FS is the filesystem backend used for all on disk operations. When
+	// nil, a real-OS backed implementation is used.
+	FS VFS
+	// ReadBufferSize bounds how much of a msg block Lookup pulls into
+	// memory at a time. On a miss, a contiguous window of this size
+	// (starting at the requested message's offset) is read in and served
+	// from until a Lookup falls outside it. Zero means unbounded - the
+	// whole block is cached, which is fine for blocks that comfortably
+	// fit in memory and is the default.
+	ReadBufferSize uint64
+	// Dedup enables content-addressed payload storage: StoreMsg hashes
+	// each payload and, when a prior message already holds the same
+	// payload on disk, stores a reference to it instead of a second copy.
+	// Disabled by default, since it costs a hash per StoreMsg.
+	Dedup bool
+	// MirrorDir, when set, points at a sibling copy of StoreDir - e.g. a
+	// replica kept by some external process - that Repair(RepairMirror)
+	// may read known-good bytes from to heal a corrupt record.
+	MirrorDir string
+	// Force allows RestoreSnapshot to install into a StoreDir that already
+	// has files in it, overwriting anything with the same name. Ignored
+	// everywhere else. Unset by default, so a restore into the wrong
+	// directory fails loudly instead of clobbering it.
+	Force bool
+}
+
+// RepairPolicy selects how FileStore.Repair handles a corrupt message
+// record it finds.
+type RepairPolicy int
+
+const (
+	// RepairTruncate drops a corrupt record and everything after it in
+	// its block, on the assumption that a corrupt length or offset has
+	// made the rest of the block unparsable.
+	RepairTruncate RepairPolicy = iota
+	// RepairQuarantine rewrites a corrupt record into the same erased
+	// "tombstone" form EraseMsg produces, without disturbing any other
+	// record in the block.
+	RepairQuarantine
+	// RepairMirror heals a corrupt record from the same offset in
+	// FileStoreConfig.MirrorDir when that copy validates, falling back
+	// to RepairQuarantine otherwise (including when MirrorDir is unset).
+	RepairMirror
+)
+
+// RecoveryReport is returned by newFileStore describing whether it found
+// an unclean shutdown marker from a prior run and, if so, the outcome of
+// the automatic Repair(RepairQuarantine) pass that followed.
+type RecoveryReport struct {
+	// Ran is true if an unclean shutdown was detected and Repair ran.
+	Ran bool
+	// Dropped lists the sequences Repair quarantined.
+	Dropped []uint64
+}
+
+// MsgSetStats reports on the health and usage of a MsgSet's backing store.
+type MsgSetStats struct {
+	Msgs     uint64
+	Bytes    uint64
+	FirstSeq uint64
+	LastSeq  uint64
+
+	// ReadCacheHits and ReadCacheMisses track Lookup's read-ahead window:
+	// a hit served entirely from the in-memory window, a miss triggered a
+	// fresh read from disk.
+	ReadCacheHits   uint64
+	ReadCacheMisses uint64
+
+	// DedupSavedBytes is the cumulative payload size avoided by storing a
+	// dedup hash reference instead of a second copy. Always zero unless
+	// FileStoreConfig.Dedup is set.
+	DedupSavedBytes uint64
+}
+
+// Errors specific to the file store.
+var (
+	ErrStoreClosed      = fmt.Errorf("filestore: store is closed")
+	ErrNoMsgSetName     = fmt.Errorf("filestore: message set name is required")
+	ErrBadStorageType   = fmt.Errorf("filestore: storage type must be FileStorage")
+	ErrStoreDirMissing  = fmt.Errorf("filestore: store directory does not exist")
+	ErrStoreMsgNotFound = fmt.Errorf("filestore: no message found")
+	ErrStoreDirNotEmpty = fmt.Errorf("filestore: store directory is not empty, use FileStoreConfig.Force to overwrite")
+	ErrSnapshotManifest = fmt.Errorf("filestore: snapshot is missing or has a malformed manifest")
+	ErrSnapshotCorrupt  = fmt.Errorf("filestore: snapshot entry failed manifest CRC validation")
+)
+
+// msgID tracks just the sequence/timestamp pair for the first or last
+// message held in a block.
+type msgID struct {
+	seq uint64
+	ts  int64
+}
+
+// msgIndex is the in-memory (and on disk, in the block's .idx file) record
+// of where a given sequence lives within its block's message file.
+type msgIndex struct {
+	seq     uint64
+	ts      int64
+	off     int64
+	rl      uint64
+	deleted bool
+
+	// hasHash, hashRef and hash back FileStoreConfig.Dedup bookkeeping.
+	// hasHash is false for every message when Dedup is off. When true,
+	// hash is the payload's content hash; hashRef says whether this
+	// record's body holds that hash (true) or is itself the canonical
+	// copy of the payload other records with the same hash point at
+	// (false).
+	hasHash bool
+	hashRef bool
+	hash    [dedupHashSize]byte
+}
+
+const msgIndexRecSize = 8 + 8 + 8 + 8 + 1 + 1 + dedupHashSize
+
+// msgBlock represents a single contiguous run of messages backed by a
+// pair of files, <index>.blk (the message bytes) and <index>.idx (the
+// index of where each sequence lives within the block).
+type msgBlock struct {
+	mu    sync.RWMutex
+	fs    *fileStore
+	index uint64
+
+	mfn string
+	mfd File
+	ifn string
+	ifd File
+
+	first msgID
+	last  msgID
+
+	msgs   uint64
+	bytes  uint64
+	rbytes uint64
+	ifRecs uint64 // count of index records physically appended to ifd
+
+	idx []*msgIndex
+
+	// cache holds a read-ahead window of this block's raw bytes, covering
+	// [cacheOff, cacheOff+len(cache)) of the block file, so that a run of
+	// sequential Lookups can be served from memory instead of paying a
+	// ReadAt per message. It is lazily (re)loaded on a window miss.
+	cache    []byte
+	cacheOff int64
+
+	// blkCRC is a rolling crc32 over every record appended to this block
+	// in order, persisted to its .sum trailer on flush/rotate so Repair
+	// can cheaply tell whether the block changed since the last flush
+	// before paying for a full per-record scan.
+	blkCRC uint32
+}
+
+// blockTrailer is the small per-block summary persisted to a block's .sum
+// file on flush/rotate.
+type blockTrailer struct {
+	CRC   uint32 `json:"crc"`
+	NRecs uint64 `json:"nrecs"`
+}
+
+// ensureWindow makes sure mb.cache covers mi's record, reloading a window
+// of FileStoreConfig.ReadBufferSize bytes (or the whole block, when unset)
+// starting at mi's offset if the current window does not. Caller must hold
+// mb.mu.
+func (mb *msgBlock) ensureWindow(mi *msgIndex) error {
+	end := mi.off + int64(mi.rl)
+	if mb.cache != nil && mi.off >= mb.cacheOff && end <= mb.cacheOff+int64(len(mb.cache)) {
+		atomic.AddUint64(&mb.fs.rdHits, 1)
+		return nil
+	}
+
+	var start, size int64
+	if mb.fs.fcfg.ReadBufferSize == 0 {
+		// Unbounded: cache the whole block from the start.
+		start, size = 0, int64(mb.rbytes)
+	} else {
+		start = mi.off
+		size = int64(mb.fs.fcfg.ReadBufferSize)
+		if size < int64(mi.rl) {
+			size = int64(mi.rl)
+		}
+		if start+size > int64(mb.rbytes) {
+			size = int64(mb.rbytes) - start
+		}
+	}
+
+	buf := make([]byte, size)
+	if _, err := mb.mfd.ReadAt(buf, start); err != nil && err != io.EOF {
+		return err
+	}
+	mb.cache = buf
+	mb.cacheOff = start
+	atomic.AddUint64(&mb.fs.rdMisses, 1)
+	return nil
+}
+
+// invalidateCache drops this block's read-ahead window, e.g. because it is
+// now stale relative to what is on disk.
+func (mb *msgBlock) invalidateCache() {
+	mb.cache = nil
+	mb.cacheOff = 0
+}
+
+// fileStore is a FileStorage backed store for a single message set.
+type fileStore struct {
+	mu       sync.RWMutex
+	fcfg     FileStoreConfig
+	cfg      MsgSetConfig
+	fs       VFS
+	storeDir string
+
+	blks []*msgBlock
+	lmb  *msgBlock
+
+	msgs  uint64
+	bytes uint64
+	first uint64
+	last  uint64
+
+	qch    chan struct{}
+	closed bool
+
+	// rdHits and rdMisses back MsgSetStats.ReadCacheHits/ReadCacheMisses and
+	// are updated from msgBlock.ensureWindow, which runs under mb.mu rather
+	// than fs.mu - hence the atomics.
+	rdHits   uint64
+	rdMisses uint64
+
+	// dedupIdx maps a payload's content hash to where its one on-disk
+	// copy lives, for FileStoreConfig.Dedup. dedupFd/dedupRecs track the
+	// append-only on disk log (dedupIndexFile) backing it, mirroring how
+	// a msgBlock's idx file backs its in-memory idx slice. All three are
+	// only populated when fcfg.Dedup is set, and are protected by fs.mu
+	// like the rest of this struct.
+	dedupIdx        map[[dedupHashSize]byte]*dedupEntry
+	dedupFd         File
+	dedupRecs       uint64
+	dedupSavedBytes uint64
+}
+
+// dedupEntry is the canonical on-disk location of a deduplicated payload,
+// keyed by its content hash.
+type dedupEntry struct {
+	hash     [dedupHashSize]byte
+	blockID  uint64
+	off      int64
+	rl       uint64
+	refcount uint64
+}
+
+const dedupEntryRecSize = dedupHashSize + 8 + 8 + 8 + 8
+
+func encodeDedupEntry(e *dedupEntry) []byte {
+	buf := make([]byte, dedupEntryRecSize)
+	le := binary.LittleEndian
+	copy(buf[0:dedupHashSize], e.hash[:])
+	o := dedupHashSize
+	le.PutUint64(buf[o:o+8], e.blockID)
+	le.PutUint64(buf[o+8:o+16], uint64(e.off))
+	le.PutUint64(buf[o+16:o+24], e.rl)
+	le.PutUint64(buf[o+24:o+32], e.refcount)
+	return buf
+}
+
+// newFileStore creates a new file backed store for the given message set.
+func newFileStore(fcfg FileStoreConfig, cfg MsgSetConfig) (*fileStore, *RecoveryReport, error) {
+	if cfg.Storage != FileStorage {
+		return nil, nil, ErrBadStorageType
+	}
+	if cfg.Name == "" {
+		return nil, nil, ErrNoMsgSetName
+	}
+	if fcfg.FS == nil {
+		fcfg.FS = newOSFS()
+	}
+	if fcfg.BlockSize == 0 {
+		fcfg.BlockSize = defaultBlockSize
+	}
+	if fi, err := fcfg.FS.Stat(fcfg.StoreDir); err != nil || !fi.IsDir() {
+		return nil, nil, ErrStoreDirMissing
+	}
+
+	fs := &fileStore{
+		fcfg:     fcfg,
+		cfg:      cfg,
+		fs:       fcfg.FS,
+		storeDir: fcfg.StoreDir,
+	}
+
+	mdir := filepath.Join(fs.storeDir, msgDir)
+	if err := fs.fs.MkdirAll(mdir, 0755); err != nil {
+		return nil, nil, fmt.Errorf("filestore: could not create msgs directory: %v", err)
+	}
+
+	// The marker is still present from a prior run only if that run never
+	// reached Stop - i.e. the process crashed or was killed mid-flight.
+	_, statErr := fs.fs.Stat(fs.dirtyMarkerPath())
+	uncleanShutdown := statErr == nil
+
+	if fs.fcfg.Dedup {
+		if err := fs.openDedupIndex(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := fs.recoverMsgs(); err != nil {
+		return nil, nil, err
+	}
+
+	report := &RecoveryReport{}
+	if uncleanShutdown {
+		// verifyRecord resolves hash references through fs.dedupIdx, so
+		// it has to be populated before Repair judges which records are
+		// corrupt; it is rebuilt again below once repair has run.
+		if fs.fcfg.Dedup {
+			if err := fs.rebuildDedupIndex(); err != nil {
+				return nil, nil, err
+			}
+		}
+		dropped, err := fs.repairLocked(RepairQuarantine)
+		if err != nil {
+			return nil, nil, err
+		}
+		report.Ran = true
+		report.Dropped = dropped
+	}
+
+	// Messages that already aged out while the store was closed must not
+	// be counted as live just because the background ageCheckLoop ticker
+	// (started below) has not had its first tick yet.
+	if fs.cfg.MaxAge > 0 {
+		fs.expireMsgs()
+	}
+
+	// Rebuilt last, once repair and expiry have settled which records in
+	// fs.blks are actually still live, so the index isn't built against
+	// entries about to be quarantined or expired out from under it.
+	if fs.fcfg.Dedup {
+		if err := fs.rebuildDedupIndex(); err != nil {
+			return nil, nil, err
+		}
+		if err := fs.rewriteDedupIndex(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := fs.markDirty(); err != nil {
+		return nil, nil, err
+	}
+
+	fs.startAgeChk()
+
+	return fs, report, nil
+}
+
+// msgDirPath returns the directory holding message blocks for this store.
+func (fs *fileStore) msgDirPath() string {
+	return filepath.Join(fs.storeDir, msgDir)
+}
+
+func (fs *fileStore) blkPath(index uint64) string {
+	return filepath.Join(fs.msgDirPath(), fmt.Sprintf(blkScan, index))
+}
+
+func (fs *fileStore) idxPath(index uint64) string {
+	return filepath.Join(fs.msgDirPath(), fmt.Sprintf(idxScan, index))
+}
+
+func (fs *fileStore) blkSumPath(index uint64) string {
+	return filepath.Join(fs.msgDirPath(), fmt.Sprintf(blkSumScan, index))
+}
+
+func (fs *fileStore) dirtyMarkerPath() string {
+	return filepath.Join(fs.storeDir, dirtyMarkerFile)
+}
+
+// markDirty creates the unclean-shutdown marker. It is removed by Stop, so
+// finding it already present on the next newFileStore means that call
+// never happened.
+func (fs *fileStore) markDirty() error {
+	f, err := fs.fs.Create(fs.dirtyMarkerPath())
+	if err != nil {
+		return fmt.Errorf("filestore: could not create dirty marker: %v", err)
+	}
+	return f.Close()
+}
+
+// writeBlockTrailer persists mb's current rolling CRC to its .sum file.
+// Called when mb is flushed or rotated out as the store's last block.
+func (fs *fileStore) writeBlockTrailer(mb *msgBlock) error {
+	t := blockTrailer{CRC: mb.blkCRC, NRecs: uint64(len(mb.idx))}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	f, err := fs.fs.Create(fs.blkSumPath(mb.index))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return err
+}
+
+// readBlockTrailer reads back the .sum file written by writeBlockTrailer.
+func (fs *fileStore) readBlockTrailer(index uint64) (blockTrailer, error) {
+	var t blockTrailer
+	f, err := fs.fs.Open(fs.blkSumPath(index))
+	if err != nil {
+		return t, err
+	}
+	defer f.Close()
+	buf, err := readAllFile(f)
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(buf, &t)
+	return t, err
+}
+
+func (fs *fileStore) dedupIndexPath() string {
+	return filepath.Join(fs.storeDir, dedupIndexFile)
+}
+
+// openDedupIndex opens (creating if needed) dedupIndexFile, the on disk
+// log persistDedupEntry appends to as refcounts change during this
+// process's lifetime. Its contents are never trusted on their own -
+// rebuildDedupIndex derives fs.dedupIdx from the message blocks themselves
+// once recovery has settled what is actually live, and rewriteDedupIndex
+// then makes this log match that result.
+func (fs *fileStore) openDedupIndex() error {
+	fd, err := fs.fs.OpenFile(fs.dedupIndexPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("filestore: could not open dedup index: %v", err)
+	}
+	fs.dedupFd = fd
+	fs.dedupIdx = make(map[[dedupHashSize]byte]*dedupEntry)
+	return nil
+}
+
+// rebuildDedupIndex derives fs.dedupIdx from fs.blks rather than trusting
+// dedupIndexFile, so a crash mid-append (or simply skipping a recovery
+// that changed which records are live, e.g. Repair or expiry) can never
+// leave it diverged from the blocks it is supposed to describe. Each live,
+// non-hashRef record with hasHash set is the canonical copy of its
+// payload; its offset is recovered by re-decoding the record, and its
+// refcount is the number of live records - canonical plus every live
+// hashRef - that share its hash. Caller must hold fs.mu and run only
+// after fs.blks reflects the final post-recovery state.
+func (fs *fileStore) rebuildDedupIndex() error {
+	fs.dedupIdx = make(map[[dedupHashSize]byte]*dedupEntry)
+
+	for _, mb := range fs.blks {
+		buf, err := readAllFile(mb.mfd)
+		if err != nil {
+			return fmt.Errorf("filestore: could not read block %d for dedup recovery: %v", mb.index, err)
+		}
+		for _, mi := range mb.idx {
+			if mi.deleted || !mi.hasHash || mi.hashRef {
+				continue
+			}
+			if mi.off < 0 || uint64(mi.off)+mi.rl > uint64(len(buf)) {
+				continue
+			}
+			subj, body, _, _, _, err := msgFromBuf(buf[mi.off : uint64(mi.off)+mi.rl])
+			if err != nil {
+				continue
+			}
+			fs.dedupIdx[mi.hash] = &dedupEntry{
+				hash:    mi.hash,
+				blockID: mb.index,
+				off:     mi.off + int64(msgHdrSize) + int64(len(subj)),
+				rl:      uint64(len(body)),
+			}
+		}
+	}
+
+	for _, mb := range fs.blks {
+		for _, mi := range mb.idx {
+			if mi.deleted || !mi.hasHash {
+				continue
+			}
+			if e, ok := fs.dedupIdx[mi.hash]; ok {
+				e.refcount++
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteDedupIndex rewrites dedupIndexFile from scratch to match
+// fs.dedupIdx, so the on disk log reflects what rebuildDedupIndex just
+// derived from the blocks instead of whatever was appended before this
+// recovery. Caller must hold fs.mu.
+func (fs *fileStore) rewriteDedupIndex() error {
+	buf := make([]byte, 0, len(fs.dedupIdx)*dedupEntryRecSize)
+	for _, e := range fs.dedupIdx {
+		buf = append(buf, encodeDedupEntry(e)...)
+	}
+	if err := fs.dedupFd.Truncate(0); err != nil {
+		return err
+	}
+	if len(buf) > 0 {
+		if _, err := fs.dedupFd.WriteAt(buf, 0); err != nil {
+			return err
+		}
+	}
+	fs.dedupRecs = uint64(len(fs.dedupIdx))
+	return nil
+}
+
+// persistDedupEntry appends e's current state to dedupIndexFile. Caller
+// must hold fs.mu. A failed append leaves fs.dedupRecs unchanged, since
+// bumping it regardless would desync every later append's offset from
+// what is actually on disk - the log would look fine right up until the
+// next recovery tried to rewrite it.
+func (fs *fileStore) persistDedupEntry(e *dedupEntry) {
+	if _, err := fs.dedupFd.WriteAt(encodeDedupEntry(e), int64(fs.dedupRecs)*dedupEntryRecSize); err != nil {
+		return
+	}
+	fs.dedupRecs++
+}
+
+// decDedupRef drops one reference to hash, freeing the entry once no
+// message holds it any longer. Caller must hold fs.mu.
+func (fs *fileStore) decDedupRef(hash [dedupHashSize]byte) {
+	e, ok := fs.dedupIdx[hash]
+	if !ok {
+		return
+	}
+	if e.refcount <= 1 {
+		delete(fs.dedupIdx, hash)
+		fs.persistDedupEntry(&dedupEntry{hash: hash})
+		return
+	}
+	e.refcount--
+	fs.persistDedupEntry(e)
+}
+
+// blockByID returns the msgBlock with the given index, or nil. fs.blks is
+// kept sorted by index (blocks are only ever appended with an increasing
+// index), so this can binary search rather than scan. Caller must hold
+// fs.mu (at least for reading).
+func (fs *fileStore) blockByID(index uint64) *msgBlock {
+	i := sort.Search(len(fs.blks), func(i int) bool { return fs.blks[i].index >= index })
+	if i < len(fs.blks) && fs.blks[i].index == index {
+		return fs.blks[i]
+	}
+	return nil
+}
+
+// resolveDedupRef reads back the canonical payload bytes a dedup hash
+// reference points at. Caller must hold fs.mu (at least for reading).
+func (fs *fileStore) resolveDedupRef(hash [dedupHashSize]byte) ([]byte, error) {
+	e, ok := fs.dedupIdx[hash]
+	if !ok {
+		return nil, ErrStoreMsgNotFound
+	}
+	pb := fs.blockByID(e.blockID)
+	if pb == nil {
+		return nil, ErrStoreMsgNotFound
+	}
+	buf := make([]byte, e.rl)
+	// A short read - e.g. the block was truncated out from under this
+	// entry - must not come back as a zero-padded "success": treat
+	// anything less than a full read, io.EOF included, as not found
+	// rather than silently handing back garbage.
+	n, err := pb.mfd.ReadAt(buf, e.off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if uint64(n) != e.rl {
+		return nil, ErrStoreMsgNotFound
+	}
+	return buf, nil
+}
+
+// recoverMsgs scans the msgs directory, rebuilding each block's in memory
+// index and the overall store first/last/msgs/bytes counters.
+func (fs *fileStore) recoverMsgs() error {
+	fis, err := fs.fs.Readdir(fs.msgDirPath())
+	if err != nil {
+		return fmt.Errorf("filestore: could not read msgs directory: %v", err)
+	}
+
+	var indexes []uint64
+	seen := make(map[uint64]bool)
+	for _, fi := range fis {
+		var idx uint64
+		// Sscanf reports n == 1 as soon as %d is consumed, even if the
+		// literal suffix doesn't match (e.g. "5.sum" against "%d.blk"),
+		// so confirm the full name round-trips before trusting idx -
+		// this also keeps the .sum trailer files Repair writes from
+		// being mistaken for message blocks.
+		if n, _ := fmt.Sscanf(fi.Name(), blkScan, &idx); n == 1 && !seen[idx] && fmt.Sprintf(blkScan, idx) == fi.Name() {
+			seen[idx] = true
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	for _, idx := range indexes {
+		mb, err := fs.recoverMsgBlock(idx)
+		if err != nil {
+			return err
+		}
+		fs.blks = append(fs.blks, mb)
+		fs.lmb = mb
+		fs.msgs += mb.msgs
+		fs.bytes += mb.bytes
+	}
+
+	if fs.msgs > 0 {
+		for _, mb := range fs.blks {
+			if mb.msgs > 0 {
+				fs.first = mb.first.seq
+				break
+			}
+		}
+		fs.last = fs.blks[len(fs.blks)-1].last.seq
+	} else if meta, err := fs.readMeta(); err == nil {
+		fs.first, fs.last = meta.First, meta.Last
+	}
+
+	if fs.lmb == nil {
+		mb, err := fs.newMsgBlock()
+		if err != nil {
+			return err
+		}
+		fs.lmb = mb
+	}
+
+	return nil
+}
+
+// recoverMsgBlock opens the on disk files for the block at index and
+// replays its index file to rebuild live/deleted bookkeeping.
+func (fs *fileStore) recoverMsgBlock(index uint64) (*msgBlock, error) {
+	mb := &msgBlock{fs: fs, index: index, mfn: fs.blkPath(index), ifn: fs.idxPath(index)}
+
+	mfd, err := fs.fs.OpenFile(mb.mfn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("filestore: could not open block file: %v", err)
+	}
+	mb.mfd = mfd
+
+	ifd, err := fs.fs.OpenFile(mb.ifn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("filestore: could not open index file: %v", err)
+	}
+	mb.ifd = ifd
+
+	buf, err := readAllFile(ifd)
+	if err != nil {
+		return nil, fmt.Errorf("filestore: could not read index file: %v", err)
+	}
+
+	latest := make(map[uint64]*msgIndex)
+	var order []uint64
+	var nrecs uint64
+	for off := 0; off+msgIndexRecSize <= len(buf); off += msgIndexRecSize {
+		mi := decodeIndexEntry(buf[off : off+msgIndexRecSize])
+		if _, ok := latest[mi.seq]; !ok {
+			order = append(order, mi.seq)
+		}
+		latest[mi.seq] = mi
+		nrecs++
+	}
+	mb.ifRecs = nrecs
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+
+	for _, seq := range order {
+		mi := latest[seq]
+		mb.idx = append(mb.idx, mi)
+		end := uint64(mi.off) + mi.rl
+		if end > mb.rbytes {
+			mb.rbytes = end
+		}
+		// last tracks the highest sequence ever allocated to this block,
+		// live or not - StoreMsg sequences never move backwards even if
+		// the most recent message is later removed.
+		mb.last = msgID{seq: mi.seq, ts: mi.ts}
+		if mi.deleted {
+			continue
+		}
+		if mb.first.seq == 0 {
+			mb.first = msgID{seq: mi.seq, ts: mi.ts}
+		}
+		mb.msgs++
+		mb.bytes += mi.rl
+	}
+
+	if fi, err := fs.fs.Stat(mb.mfn); err == nil {
+		if sz := uint64(fi.Size()); sz > mb.rbytes {
+			mb.rbytes = sz
+		}
+	}
+
+	// The rolling CRC only lives in memory, so rebuild it by rehashing
+	// the block's current bytes rather than trusting the last .sum -
+	// which may predate writes made since that last flush/rotate.
+	if mbuf, err := readAllFile(mfd); err == nil {
+		mb.blkCRC = crc32.ChecksumIEEE(mbuf)
+	}
+
+	return mb, nil
+}
+
+// newMsgBlock creates and opens the next message block, making it the
+// store's last msg block (lmb).
+func (fs *fileStore) newMsgBlock() (*msgBlock, error) {
+	if fs.lmb != nil {
+		fs.writeBlockTrailer(fs.lmb)
+	}
+
+	index := uint64(1)
+	if fs.lmb != nil {
+		index = fs.lmb.index + 1
+	}
+	mb := &msgBlock{fs: fs, index: index, mfn: fs.blkPath(index), ifn: fs.idxPath(index)}
+
+	mfd, err := fs.fs.OpenFile(mb.mfn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("filestore: could not create block file: %v", err)
+	}
+	mb.mfd = mfd
+
+	ifd, err := fs.fs.OpenFile(mb.ifn, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("filestore: could not create index file: %v", err)
+	}
+	mb.ifd = ifd
+
+	fs.blks = append(fs.blks, mb)
+	fs.lmb = mb
+	return mb, nil
+}
+
+// fileStoreMsgSize returns the number of bytes a msg with the given subject
+// and payload will occupy once written to a message block.
+func fileStoreMsgSize(subj string, msg []byte) uint64 {
+	return uint64(msgHdrSize+msgTrailerLen) + uint64(len(subj)) + uint64(len(msg))
+}
+
+func encodeMsgRecord(seq uint64, ts int64, subj string, msg []byte) []byte {
+	return encodeMsgRecordFlags(seq, ts, subj, msg, 0)
+}
+
+// encodeMsgRecordFlags is encodeMsgRecord with an explicit flags byte,
+// e.g. msgFlagHashRef when body is a dedup hash rather than the payload.
+func encodeMsgRecordFlags(seq uint64, ts int64, subj string, body []byte, flags uint8) []byte {
+	slen := uint16(len(subj))
+	rl := msgHdrSize + int(slen) + len(body) + msgTrailerLen
+	buf := make([]byte, rl)
+	le := binary.LittleEndian
+
+	le.PutUint32(buf[0:4], uint32(rl))
+	le.PutUint64(buf[4:12], seq)
+	le.PutUint64(buf[12:20], uint64(ts))
+	buf[20] = flags
+	le.PutUint16(buf[21:23], slen)
+	copy(buf[msgHdrSize:msgHdrSize+int(slen)], subj)
+	copy(buf[msgHdrSize+int(slen):rl-msgTrailerLen], body)
+
+	crc := crc32.ChecksumIEEE(buf[:rl-msgTrailerLen])
+	le.PutUint32(buf[rl-msgTrailerLen:], crc)
+	return buf
+}
+
+// msgFromBuf decodes a single message record, previously encoded via
+// encodeMsgRecord/encodeMsgRecordFlags, validating its checksum. The
+// returned subject is a copy, but body aliases buf rather than copying it, so that a
+// Lookup served from a block's in-memory cache continues to observe later
+// in-place mutations of that cache (e.g. from EraseMsg). body holds the
+// dedup hash rather than the payload when the returned flags has
+// msgFlagHashRef set.
+func msgFromBuf(buf []byte) (string, []byte, uint64, int64, uint8, error) {
+	if len(buf) < msgHdrSize+msgTrailerLen {
+		return "", nil, 0, 0, 0, fmt.Errorf("filestore: short record")
+	}
+	le := binary.LittleEndian
+	rl := le.Uint32(buf[0:4])
+	if int(rl) != len(buf) {
+		return "", nil, 0, 0, 0, fmt.Errorf("filestore: record length mismatch, possible corruption")
+	}
+	seq := le.Uint64(buf[4:12])
+	ts := int64(le.Uint64(buf[12:20]))
+	flags := buf[20]
+	slen := int(le.Uint16(buf[21:23]))
+
+	if msgHdrSize+slen > len(buf)-msgTrailerLen {
+		return "", nil, 0, 0, 0, fmt.Errorf("filestore: corrupt record")
+	}
+
+	crc := le.Uint32(buf[len(buf)-msgTrailerLen:])
+	if crc32.ChecksumIEEE(buf[:len(buf)-msgTrailerLen]) != crc {
+		return "", nil, 0, 0, 0, fmt.Errorf("filestore: checksum mismatch, possible corruption")
+	}
+
+	subj := string(buf[msgHdrSize : msgHdrSize+slen])
+	body := buf[msgHdrSize+slen : len(buf)-msgTrailerLen]
+
+	return subj, body, seq, ts, flags, nil
+}
+
+func encodeIndexEntry(mi *msgIndex) []byte {
+	buf := make([]byte, msgIndexRecSize)
+	le := binary.LittleEndian
+	le.PutUint64(buf[0:8], mi.seq)
+	le.PutUint64(buf[8:16], uint64(mi.ts))
+	le.PutUint64(buf[16:24], uint64(mi.off))
+	le.PutUint64(buf[24:32], mi.rl)
+	if mi.deleted {
+		buf[32] = 1
+	}
+	if mi.hasHash {
+		buf[33] = 1
+	}
+	if mi.hashRef {
+		buf[33] |= 2
+	}
+	copy(buf[34:34+dedupHashSize], mi.hash[:])
+	return buf
+}
+
+func decodeIndexEntry(buf []byte) *msgIndex {
+	le := binary.LittleEndian
+	mi := &msgIndex{
+		seq:     le.Uint64(buf[0:8]),
+		ts:      int64(le.Uint64(buf[8:16])),
+		off:     int64(le.Uint64(buf[16:24])),
+		rl:      le.Uint64(buf[24:32]),
+		deleted: buf[32] == 1,
+		hasHash: buf[33]&1 != 0,
+		hashRef: buf[33]&2 != 0,
+	}
+	copy(mi.hash[:], buf[34:34+dedupHashSize])
+	return mi
+}
+
+func readAllFile(f File) ([]byte, error) {
+	var buf []byte
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := f.ReadAt(chunk, int64(len(buf)))
+		if n > 0 {
+			buf = append(buf, chunk[:n]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return buf, nil
+}
+
+// StoreMsg stores a message for the given subject and returns its assigned
+// sequence number.
+func (fs *fileStore) StoreMsg(subject string, msg []byte) (uint64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return 0, ErrStoreClosed
+	}
+
+	seq := fs.last + 1
+	now := time.Now().UnixNano()
+	fullRL := fileStoreMsgSize(subject, msg)
+
+	mb := fs.lmb
+	if mb != nil && mb.rbytes > 0 && mb.rbytes+fullRL > fs.fcfg.BlockSize {
+		var err error
+		mb, err = fs.newMsgBlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// With Dedup on and a payload large enough for a hash reference to
+	// actually save space, look up whether this exact payload already
+	// has a canonical copy on disk.
+	var hash [dedupHashSize]byte
+	var useDedup bool
+	var dedupHit *dedupEntry
+	if fs.fcfg.Dedup && len(msg) > dedupHashSize {
+		hash = sha256.Sum256(msg)
+		useDedup = true
+		dedupHit = fs.dedupIdx[hash]
+	}
+
+	var buf []byte
+	if dedupHit != nil {
+		buf = encodeMsgRecordFlags(seq, now, subject, hash[:], msgFlagHashRef)
+	} else {
+		buf = encodeMsgRecord(seq, now, subject, msg)
+	}
+	rl := uint64(len(buf))
+
+	off := int64(mb.rbytes)
+	if _, err := mb.mfd.WriteAt(buf, off); err != nil {
+		return 0, err
+	}
+	mb.blkCRC = crc32.Update(mb.blkCRC, crc32.IEEETable, buf)
+	// A write to the last block can land past the end of, or overwrite
+	// part of, whatever window is currently cached - simplest and safest
+	// is to drop it and let the next Lookup reload on demand.
+	mb.mu.Lock()
+	mb.invalidateCache()
+	mb.mu.Unlock()
+
+	mi := &msgIndex{seq: seq, ts: now, off: off, rl: rl, hasHash: useDedup, hashRef: dedupHit != nil, hash: hash}
+	if _, err := mb.ifd.WriteAt(encodeIndexEntry(mi), int64(mb.ifRecs)*msgIndexRecSize); err != nil {
+		return 0, err
+	}
+	mb.ifRecs++
+	mb.idx = append(mb.idx, mi)
+	mb.rbytes += rl
+	mb.bytes += rl
+	mb.msgs++
+	if mb.first.seq == 0 {
+		mb.first = msgID{seq: seq, ts: now}
+	}
+	mb.last = msgID{seq: seq, ts: now}
+
+	if useDedup {
+		if dedupHit != nil {
+			dedupHit.refcount++
+			fs.persistDedupEntry(dedupHit)
+			fs.dedupSavedBytes += fullRL - rl
+		} else {
+			e := &dedupEntry{
+				hash:     hash,
+				blockID:  mb.index,
+				off:      off + int64(msgHdrSize) + int64(len(subject)),
+				rl:       uint64(len(msg)),
+				refcount: 1,
+			}
+			fs.dedupIdx[hash] = e
+			fs.persistDedupEntry(e)
+		}
+	}
+
+	fs.last = seq
+	if fs.first == 0 {
+		fs.first = seq
+	}
+	fs.bytes += rl
+	fs.msgs++
+
+	fs.enforceLimits()
+
+	return seq, nil
+}
+
+// enforceLimits drops the oldest messages until configured max msgs/bytes
+// are honored. Caller must hold fs.mu.
+func (fs *fileStore) enforceLimits() {
+	if fs.cfg.MaxMsgs > 0 {
+		for fs.msgs > uint64(fs.cfg.MaxMsgs) {
+			fs.removeMsgLocked(fs.first)
+		}
+	}
+	if fs.cfg.MaxBytes > 0 {
+		for fs.bytes > uint64(fs.cfg.MaxBytes) && fs.msgs > 0 {
+			fs.removeMsgLocked(fs.first)
+		}
+	}
+}
+
+// blockAndEntry locates the block and index entry for seq. Caller must
+// hold fs.mu (at least for reading).
+func (fs *fileStore) blockAndEntry(seq uint64) (*msgBlock, *msgIndex) {
+	for _, mb := range fs.blks {
+		if mb.first.seq != 0 && seq >= mb.first.seq && seq <= mb.last.seq {
+			for _, mi := range mb.idx {
+				if mi.seq == seq {
+					return mb, mi
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// removeMsgLocked soft deletes seq. Caller must hold fs.mu.
+func (fs *fileStore) removeMsgLocked(seq uint64) bool {
+	mb, mi := fs.blockAndEntry(seq)
+	if mb == nil || mi == nil || mi.deleted {
+		return false
+	}
+	mi.deleted = true
+	mb.msgs--
+	mb.bytes -= mi.rl
+	fs.msgs--
+	fs.bytes -= mi.rl
+
+	mb.mu.Lock()
+	if mb.cache != nil && mi.off < mb.cacheOff+int64(len(mb.cache)) && mi.off+int64(mi.rl) > mb.cacheOff {
+		mb.invalidateCache()
+	}
+	mb.mu.Unlock()
+
+	fs.persistTombstone(mb, mi)
+	if mi.hasHash {
+		fs.decDedupRef(mi.hash)
+	}
+
+	if seq == fs.first {
+		fs.advanceFirst()
+	}
+	return true
+}
+
+// persistTombstone appends an updated index record marking mi as deleted.
+// Index records are replayed newest-wins by sequence on recovery, so a
+// plain append is sufficient.
+func (fs *fileStore) persistTombstone(mb *msgBlock, mi *msgIndex) {
+	mb.ifd.WriteAt(encodeIndexEntry(mi), int64(mb.ifRecs)*msgIndexRecSize)
+	mb.ifRecs++
+}
+
+// advanceFirst moves fs.first forward past any deleted sequences.
+// Caller must hold fs.mu.
+func (fs *fileStore) advanceFirst() {
+	for seq := fs.first; seq <= fs.last; seq++ {
+		_, mi := fs.blockAndEntry(seq)
+		if mi != nil && !mi.deleted {
+			fs.first = seq
+			return
+		}
+	}
+	fs.first = fs.last + 1
+}
+
+// RemoveMsg removes (soft deletes) the message at seq, returning whether a
+// live message was actually found and removed.
+func (fs *fileStore) RemoveMsg(seq uint64) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.removeMsgLocked(seq)
+}
+
+// EraseMsg removes the message at seq and overwrites its payload on disk
+// so that the original content is not recoverable. The one exception is
+// a Dedup canonical copy whose payload another live message still refers
+// to: its payload bytes are kept and only the rest of the record is
+// overwritten.
+func (fs *fileStore) EraseMsg(seq uint64) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	mb, mi := fs.blockAndEntry(seq)
+	if mb == nil || mi == nil || mi.deleted {
+		return false
+	}
+
+	var erased []byte
+	if mi.hasHash && !mi.hashRef {
+		// This record holds the canonical copy of its payload. If
+		// another live message still points at the same hash, keep
+		// the payload bytes intact (only scrubbing the rest of the
+		// record) rather than destroying data still in use.
+		if e, ok := fs.dedupIdx[mi.hash]; ok && e.refcount > 1 {
+			payload := make([]byte, e.rl)
+			mb.mfd.ReadAt(payload, e.off)
+			erased = encodeEraseRecord(mi.rl)
+			rel := e.off - mi.off
+			copy(erased[rel:rel+int64(e.rl)], payload)
+		}
+	}
+	if erased == nil {
+		erased = encodeEraseRecord(mi.rl)
+	}
+	mb.mfd.WriteAt(erased, mi.off)
+	mb.mu.Lock()
+	if mb.cache != nil && mi.off >= mb.cacheOff && mi.off+int64(mi.rl) <= mb.cacheOff+int64(len(mb.cache)) {
+		rel := mi.off - mb.cacheOff
+		copy(mb.cache[rel:], erased)
+	}
+	mb.mu.Unlock()
+
+	mi.deleted = true
+	mb.msgs--
+	mb.bytes -= mi.rl
+	fs.msgs--
+	fs.bytes -= mi.rl
+	fs.persistTombstone(mb, mi)
+	if mi.hasHash {
+		fs.decDedupRef(mi.hash)
+	}
+
+	if seq == fs.first {
+		fs.advanceFirst()
+	}
+	return true
+}
+
+// encodeEraseRecord returns an rl sized record with seq/ts zeroed out and
+// the subject/msg bytes randomized, preserving the original record length.
+func encodeEraseRecord(rl uint64) []byte {
+	buf := make([]byte, rl)
+	le := binary.LittleEndian
+	le.PutUint32(buf[0:4], uint32(rl))
+	// seq, ts and flags left as zero.
+	slen := uint16(0)
+	if rl > uint64(msgHdrSize+msgTrailerLen) {
+		slen = uint16(rand.Intn(int(rl) - msgHdrSize - msgTrailerLen + 1))
+	}
+	le.PutUint16(buf[21:23], slen)
+	rand.Read(buf[msgHdrSize : rl-uint64(msgTrailerLen)])
+	crc := crc32.ChecksumIEEE(buf[:rl-uint64(msgTrailerLen)])
+	le.PutUint32(buf[rl-uint64(msgTrailerLen):], crc)
+	return buf
+}
+
+// msgForSeq returns the index entry for seq, or nil if not found.
+func (fs *fileStore) msgForSeq(seq uint64) *msgIndex {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	_, mi := fs.blockAndEntry(seq)
+	return mi
+}
+
+// Lookup returns the subject, payload and timestamp for the message at seq.
+func (fs *fileStore) Lookup(seq uint64) (string, []byte, int64, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if fs.closed {
+		return "", nil, 0, ErrStoreClosed
+	}
+	mb, mi := fs.blockAndEntry(seq)
+	if mb == nil || mi == nil || mi.deleted {
+		return "", nil, 0, ErrStoreMsgNotFound
+	}
+
+	mb.mu.Lock()
+	if err := mb.ensureWindow(mi); err != nil {
+		mb.mu.Unlock()
+		return "", nil, 0, err
+	}
+	rel := mi.off - mb.cacheOff
+	if rel < 0 || int64(len(mb.cache)) < rel+int64(mi.rl) {
+		mb.mu.Unlock()
+		return "", nil, 0, ErrStoreMsgNotFound
+	}
+	buf := mb.cache[rel : rel+int64(mi.rl)]
+	mb.mu.Unlock()
+
+	subj, body, rseq, ts, flags, err := msgFromBuf(buf)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if rseq != seq {
+		return "", nil, 0, ErrStoreMsgNotFound
+	}
+	if flags&msgFlagHashRef == 0 {
+		return subj, body, ts, nil
+	}
+
+	var hash [dedupHashSize]byte
+	copy(hash[:], body)
+	msg, err := fs.resolveDedupRef(hash)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	return subj, msg, ts, nil
+}
+
+// verifyRecord reports whether mi's on disk record still validates - its
+// checksum, and, for a dedup hash reference, that the payload it resolves
+// to still hashes to the hash it was stored under. Caller must hold fs.mu
+// (at least for reading).
+func (fs *fileStore) verifyRecord(mb *msgBlock, mi *msgIndex) bool {
+	buf := make([]byte, mi.rl)
+	if _, err := mb.mfd.ReadAt(buf, mi.off); err != nil && err != io.EOF {
+		return false
+	}
+	_, body, rseq, _, flags, err := msgFromBuf(buf)
+	if err != nil || rseq != mi.seq {
+		return false
+	}
+	if flags&msgFlagHashRef != 0 {
+		var hash [dedupHashSize]byte
+		copy(hash[:], body)
+		payload, err := fs.resolveDedupRef(hash)
+		if err != nil || sha256.Sum256(payload) != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMsgs walks every live index entry, validating it via verifyRecord,
+// and returns the sequences of any msgs that fail to validate.
+func (fs *fileStore) checkMsgs() []uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var bad []uint64
+	for _, mb := range fs.blks {
+		for _, mi := range mb.idx {
+			if mi.deleted {
+				continue
+			}
+			if !fs.verifyRecord(mb, mi) {
+				bad = append(bad, mi.seq)
+			}
+		}
+	}
+	return bad
+}
+
+// refreshBlockCRC recomputes mb.blkCRC from its current on disk bytes,
+// e.g. after Repair has altered some of them. Caller must hold fs.mu.
+func (fs *fileStore) refreshBlockCRC(mb *msgBlock) {
+	buf := make([]byte, mb.rbytes)
+	if _, err := mb.mfd.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return
+	}
+	mb.blkCRC = crc32.ChecksumIEEE(buf)
+}
+
+// blockNeedsRepairScan reports whether mb's on disk bytes no longer match
+// its last-flush trailer, in which case Repair must pay for a full
+// per-record scan to find and fix the damage. Comparing two crc32s is far
+// cheaper than parsing and dedup-resolving every record in the block, so
+// this lets Repair skip every block that hasn't rotted since its last
+// flush without reading its bytes twice.
+func (fs *fileStore) blockNeedsRepairScan(mb *msgBlock) bool {
+	t, err := fs.readBlockTrailer(mb.index)
+	if err != nil {
+		return true
+	}
+	if t.NRecs != uint64(len(mb.idx)) {
+		return true
+	}
+	buf, err := readAllFile(mb.mfd)
+	if err != nil {
+		return true
+	}
+	return t.CRC != crc32.ChecksumIEEE(buf)
+}
+
+// quarantineRecord rewrites mi's record into the erased "tombstone" form
+// EraseMsg produces and updates bookkeeping as if it had been removed.
+// Caller must hold fs.mu.
+func (fs *fileStore) quarantineRecord(mb *msgBlock, mi *msgIndex) {
+	var erased []byte
+	if mi.hasHash && !mi.hashRef {
+		// Same precaution as EraseMsg: mi is the canonical copy of its
+		// payload, and other live messages elsewhere may still resolve
+		// it by hash. Quarantining mi for damage elsewhere in its
+		// record must not take those unrelated, uncorrupted messages
+		// down with it, so the payload bytes are preserved and only the
+		// rest of the record is scrubbed - but only if the payload
+		// itself is still intact. If the bit-rot landed in the payload
+		// region too, it no longer hashes to mi.hash and there is
+		// nothing valid left to hand back, so fall through to a full
+		// erase rather than handing every referrer corrupted bytes.
+		if e, ok := fs.dedupIdx[mi.hash]; ok && e.refcount > 1 {
+			payload := make([]byte, e.rl)
+			mb.mfd.ReadAt(payload, e.off)
+			if sha256.Sum256(payload) == mi.hash {
+				erased = encodeEraseRecord(mi.rl)
+				rel := e.off - mi.off
+				copy(erased[rel:rel+int64(e.rl)], payload)
+			}
+		}
+	}
+	if erased == nil {
+		erased = encodeEraseRecord(mi.rl)
+	}
+	mb.mfd.WriteAt(erased, mi.off)
+	mb.mu.Lock()
+	mb.invalidateCache()
+	mb.mu.Unlock()
+
+	mi.deleted = true
+	mb.msgs--
+	mb.bytes -= mi.rl
+	fs.msgs--
+	fs.bytes -= mi.rl
+	fs.persistTombstone(mb, mi)
+	if mi.hasHash {
+		fs.decDedupRef(mi.hash)
+	}
+	if mi.seq == fs.first {
+		fs.advanceFirst()
+	}
+}
+
+// repairBlockQuarantine applies RepairQuarantine to every corrupt live
+// record in mb. Caller must hold fs.mu.
+func (fs *fileStore) repairBlockQuarantine(mb *msgBlock) []uint64 {
+	var dropped []uint64
+	for _, mi := range mb.idx {
+		if mi.deleted || fs.verifyRecord(mb, mi) {
+			continue
+		}
+		fs.quarantineRecord(mb, mi)
+		dropped = append(dropped, mi.seq)
+	}
+	if len(dropped) > 0 {
+		fs.refreshBlockCRC(mb)
+	}
+	return dropped
+}
+
+// repairBlockMirror applies RepairMirror to mb: a corrupt record is healed
+// in place from the same offset in FileStoreConfig.MirrorDir when that
+// copy validates, and otherwise falls back to RepairQuarantine.
+func (fs *fileStore) repairBlockMirror(mb *msgBlock) []uint64 {
+	var mfd File
+	if fs.fcfg.MirrorDir != "" {
+		mirrorPath := filepath.Join(fs.fcfg.MirrorDir, msgDir, fmt.Sprintf(blkScan, mb.index))
+		if f, err := fs.fs.Open(mirrorPath); err == nil {
+			mfd = f
+			defer f.Close()
+		}
+	}
+
+	var dropped []uint64
+	var healed bool
+	for _, mi := range mb.idx {
+		if mi.deleted || fs.verifyRecord(mb, mi) {
+			continue
+		}
+		if mfd == nil || !fs.healFromMirror(mb, mi, mfd) {
+			fs.quarantineRecord(mb, mi)
+			dropped = append(dropped, mi.seq)
+			continue
+		}
+		healed = true
+	}
+	if healed || len(dropped) > 0 {
+		fs.refreshBlockCRC(mb)
+	}
+	return dropped
+}
+
+// healFromMirror reads mi's record from the same offset in mfd and, if it
+// validates, writes it over the corrupt copy in mb. Caller must hold fs.mu.
+func (fs *fileStore) healFromMirror(mb *msgBlock, mi *msgIndex, mfd File) bool {
+	buf := make([]byte, mi.rl)
+	if _, err := mfd.ReadAt(buf, mi.off); err != nil && err != io.EOF {
+		return false
+	}
+	if _, _, rseq, _, _, err := msgFromBuf(buf); err != nil || rseq != mi.seq {
+		return false
+	}
+	if _, err := mb.mfd.WriteAt(buf, mi.off); err != nil {
+		return false
+	}
+	mb.mu.Lock()
+	mb.invalidateCache()
+	mb.mu.Unlock()
+	return true
+}
+
+// relocateDedupPayload copies e's payload bytes out of mb, which is about
+// to be truncated, into a block that will survive it, and repoints e at
+// the new location. Unlike quarantineRecord, truncation physically removes
+// the bytes rather than leaving a tombstone in place, so there is nothing
+// to preserve in place here - the payload has to move. If the payload
+// itself no longer hashes to e.hash there is nothing valid left to save,
+// and the caller's dedup refcount decrement will drop the reference as it
+// would have anyway. Caller must hold fs.mu.
+func (fs *fileStore) relocateDedupPayload(mb *msgBlock, e *dedupEntry) {
+	payload := make([]byte, e.rl)
+	if _, err := mb.mfd.ReadAt(payload, e.off); err != nil && err != io.EOF {
+		return
+	}
+	if sha256.Sum256(payload) != e.hash {
+		return
+	}
+
+	target := fs.lmb
+	if target == nil || target == mb {
+		var err error
+		if target, err = fs.newMsgBlock(); err != nil {
+			return
+		}
+	}
+
+	off := int64(target.rbytes)
+	if _, err := target.mfd.WriteAt(payload, off); err != nil {
+		return
+	}
+	target.blkCRC = crc32.Update(target.blkCRC, crc32.IEEETable, payload)
+	target.rbytes += uint64(len(payload))
+	target.mu.Lock()
+	target.invalidateCache()
+	target.mu.Unlock()
+
+	e.blockID = target.index
+	e.off = off
+	fs.persistDedupEntry(e)
+}
+
+// repairBlockTruncate applies RepairTruncate to mb: the first corrupt live
+// record found, and everything physically after it in the block, is
+// discarded on the assumption that a corrupt length or offset has made the
+// rest of the block unparsable. Caller must hold fs.mu.
+func (fs *fileStore) repairBlockTruncate(mb *msgBlock) ([]uint64, error) {
+	cut := -1
+	for i, mi := range mb.idx {
+		if mi.deleted {
+			continue
+		}
+		if !fs.verifyRecord(mb, mi) {
+			cut = i
+			break
+		}
+	}
+	if cut < 0 {
+		return nil, nil
+	}
+
+	var dropped []uint64
+	for _, mi := range mb.idx[cut:] {
+		if mi.deleted {
+			continue
+		}
+		mb.msgs--
+		mb.bytes -= mi.rl
+		fs.msgs--
+		fs.bytes -= mi.rl
+		dropped = append(dropped, mi.seq)
+		if mi.hasHash {
+			if !mi.hashRef {
+				// mi is the canonical copy of its payload, about to be
+				// physically destroyed by the truncate below. Unlike
+				// quarantine, truncation can't preserve it in place, so
+				// relocate it first if anything elsewhere still depends
+				// on it by hash.
+				if e, ok := fs.dedupIdx[mi.hash]; ok && e.refcount > 1 {
+					fs.relocateDedupPayload(mb, e)
+				}
+			}
+			fs.decDedupRef(mi.hash)
+		}
+	}
+
+	truncOff := mb.idx[cut].off
+	if err := mb.mfd.Truncate(truncOff); err != nil {
+		return dropped, err
+	}
+	mb.rbytes = uint64(truncOff)
+	mb.mu.Lock()
+	mb.invalidateCache()
+	mb.mu.Unlock()
+
+	mb.idx = mb.idx[:cut]
+	if len(mb.idx) > 0 {
+		last := mb.idx[len(mb.idx)-1]
+		mb.last = msgID{seq: last.seq, ts: last.ts}
+	} else {
+		mb.last = msgID{}
+	}
+	if err := fs.rewriteBlockIndex(mb); err != nil {
+		return dropped, err
+	}
+	fs.refreshBlockCRC(mb)
+
+	fs.advanceFirst()
+	var maxSeq uint64
+	for _, b := range fs.blks {
+		if b.last.seq > maxSeq {
+			maxSeq = b.last.seq
+		}
+	}
+	if maxSeq < fs.last {
+		fs.last = maxSeq
+	}
+	if fs.msgs == 0 {
+		fs.first = fs.last + 1
+	}
+
+	return dropped, nil
+}
+
+// rewriteBlockIndex rewrites mb's on disk index file from scratch to
+// match mb.idx, e.g. after Repair(RepairTruncate) drops entries whose
+// message bytes it just discarded. Caller must hold fs.mu.
+func (fs *fileStore) rewriteBlockIndex(mb *msgBlock) error {
+	buf := make([]byte, 0, len(mb.idx)*msgIndexRecSize)
+	for _, mi := range mb.idx {
+		buf = append(buf, encodeIndexEntry(mi)...)
+	}
+	if err := mb.ifd.Truncate(0); err != nil {
+		return err
+	}
+	if len(buf) > 0 {
+		if _, err := mb.ifd.WriteAt(buf, 0); err != nil {
+			return err
+		}
+	}
+	mb.ifRecs = uint64(len(mb.idx))
+	return nil
+}
+
+// Repair scans the store for corrupt message records and applies policy
+// to each one found, returning the sequences it acted on. It is run
+// automatically (with RepairQuarantine) by newFileStore when it detects
+// an unclean prior shutdown.
+func (fs *fileStore) Repair(policy RepairPolicy) ([]uint64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.repairLocked(policy)
+}
+
+// repairLocked implements Repair. Caller must hold fs.mu.
+func (fs *fileStore) repairLocked(policy RepairPolicy) ([]uint64, error) {
+	var dropped []uint64
+	for _, mb := range fs.blks {
+		if !fs.blockNeedsRepairScan(mb) {
+			continue
+		}
+		switch policy {
+		case RepairTruncate:
+			d, err := fs.repairBlockTruncate(mb)
+			if err != nil {
+				return dropped, err
+			}
+			dropped = append(dropped, d...)
+		case RepairMirror:
+			dropped = append(dropped, fs.repairBlockMirror(mb)...)
+		default:
+			dropped = append(dropped, fs.repairBlockQuarantine(mb)...)
+		}
+	}
+	if len(dropped) > 0 {
+		fs.writeMeta()
+	}
+	return dropped, nil
+}
+
+// numMsgBlocks returns how many message blocks currently back the store.
+func (fs *fileStore) numMsgBlocks() int {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return len(fs.blks)
+}
+
+// Purge removes all messages from the store, leaving a single empty block
+// ready to accept new messages starting at the next sequence.
+func (fs *fileStore) Purge() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Blocks, and any read-ahead windows cached on them, are discarded
+	// wholesale - nothing is left around for a later Lookup to read stale
+	// bytes from.
+	for _, mb := range fs.blks {
+		mb.mfd.Close()
+		mb.ifd.Close()
+		fs.fs.Remove(mb.mfn)
+		fs.fs.Remove(mb.ifn)
+	}
+	fs.blks = nil
+	fs.lmb = nil
+	fs.msgs, fs.bytes = 0, 0
+	fs.first = fs.last + 1
+
+	// Every block backing a dedup payload is gone, so the index has
+	// nothing left to point at.
+	if fs.fcfg.Dedup {
+		fs.dedupFd.Truncate(0)
+		fs.dedupIdx = make(map[[dedupHashSize]byte]*dedupEntry)
+		fs.dedupRecs = 0
+	}
+
+	if _, err := fs.newMsgBlock(); err != nil {
+		return err
+	}
+	return fs.writeMeta()
+}
+
+// storeMeta is the small bit of state that can outlive an empty set of
+// message blocks, persisted to storeMetaFile.
+type storeMeta struct {
+	First uint64 `json:"first_seq"`
+	Last  uint64 `json:"last_seq"`
+}
+
+func (fs *fileStore) writeMeta() error {
+	meta := storeMeta{First: fs.first, Last: fs.last}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	f, err := fs.fs.Create(filepath.Join(fs.storeDir, storeMetaFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return err
+}
+
+func (fs *fileStore) readMeta() (storeMeta, error) {
+	var meta storeMeta
+	f, err := fs.fs.Open(filepath.Join(fs.storeDir, storeMetaFile))
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	buf, err := readAllFile(f)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(buf, &meta)
+	return meta, err
+}
+
+// startAgeChk starts the background expiry goroutine when MaxAge is set.
+func (fs *fileStore) startAgeChk() {
+	if fs.cfg.MaxAge == 0 {
+		return
+	}
+	fs.qch = make(chan struct{})
+	go fs.ageCheckLoop(fs.qch)
+}
+
+func (fs *fileStore) ageCheckInterval() time.Duration {
+	iv := fs.cfg.MaxAge / 4
+	if iv < time.Millisecond {
+		iv = time.Millisecond
+	}
+	return iv
+}
+
+func (fs *fileStore) ageCheckLoop(qch chan struct{}) {
+	t := time.NewTicker(fs.ageCheckInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			fs.expireMsgs()
+		case <-qch:
+			return
+		}
+	}
+}
+
+// expireMsgs removes any msgs older than MaxAge.
+func (fs *fileStore) expireMsgs() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed || fs.msgs == 0 {
+		return
+	}
+	maxAge := int64(fs.cfg.MaxAge)
+	now := time.Now().UnixNano()
+
+	for fs.msgs > 0 {
+		_, mi := fs.blockAndEntry(fs.first)
+		if mi == nil {
+			fs.advanceFirst()
+			continue
+		}
+		if now-mi.ts < maxAge {
+			break
+		}
+		fs.removeMsgLocked(mi.seq)
+	}
+}
+
+// Stats returns a snapshot of the store's current message/byte counts and
+// sequence range.
+func (fs *fileStore) Stats() MsgSetStats {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return MsgSetStats{
+		Msgs:            fs.msgs,
+		Bytes:           fs.bytes,
+		FirstSeq:        fs.first,
+		LastSeq:         fs.last,
+		ReadCacheHits:   atomic.LoadUint64(&fs.rdHits),
+		ReadCacheMisses: atomic.LoadUint64(&fs.rdMisses),
+		DedupSavedBytes: fs.dedupSavedBytes,
+	}
+}
+
+// Stop flushes and closes all open block files for this store. Safe to call
+// more than once.
+func (fs *fileStore) Stop() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return nil
+	}
+	fs.closed = true
+	if fs.qch != nil {
+		close(fs.qch)
+		fs.qch = nil
+	}
+	for _, mb := range fs.blks {
+		mb.mfd.Sync()
+		mb.ifd.Sync()
+		fs.writeBlockTrailer(mb)
+		mb.mfd.Close()
+		mb.ifd.Close()
+	}
+	if fs.dedupFd != nil {
+		fs.dedupFd.Sync()
+		fs.dedupFd.Close()
+	}
+	fs.fs.Remove(fs.dirtyMarkerPath())
+	return fs.writeMeta()
+}
+
+// snapshotBlock is the manifest's record of one message block, letting
+// RestoreSnapshot validate its bytes before installing anything.
+type snapshotBlock struct {
+	Index   uint64 `json:"index"`
+	BlkName string `json:"blk_name"`
+	BlkSize int64  `json:"blk_size"`
+	BlkCRC  uint32 `json:"blk_crc"`
+	IdxName string `json:"idx_name"`
+	IdxSize int64  `json:"idx_size"`
+	IdxCRC  uint32 `json:"idx_crc"`
+}
+
+// snapshotManifest is the JSON payload of manifest.json, the first entry
+// in a Snapshot's tar stream. It carries the message set config and
+// sequence range alongside a per-block CRC so RestoreSnapshot can
+// reassemble and validate a StoreDir from the stream alone.
+type snapshotManifest struct {
+	Version   int             `json:"version"`
+	Cfg       MsgSetConfig    `json:"cfg"`
+	BlockSize uint64          `json:"block_size"`
+	First     uint64          `json:"first_seq"`
+	Last      uint64          `json:"last_seq"`
+	Blocks    []snapshotBlock `json:"blocks"`
+}
+
+// Snapshot writes a portable backup of the store to w: a tar archive whose
+// first entry is manifest.json (this store's config, sequence range and
+// per-block CRCs), followed by each message block's .blk and .idx file
+// under its original name. The store lock is held only long enough to
+// fsync every block and enumerate them - block bytes are read and
+// streamed afterward, so writers are blocked for a bounded enumeration,
+// not for the time it takes to ship the whole store over w. RestoreSnapshot
+// is the inverse.
+func (fs *fileStore) Snapshot(w io.Writer) error {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return ErrStoreClosed
+	}
+	blks := make([]*msgBlock, len(fs.blks))
+	copy(blks, fs.blks)
+	manifest := snapshotManifest{
+		Version:   snapshotVersion,
+		Cfg:       fs.cfg,
+		BlockSize: fs.fcfg.BlockSize,
+		First:     fs.first,
+		Last:      fs.last,
+	}
+	for _, mb := range blks {
+		mb.mfd.Sync()
+		mb.ifd.Sync()
+		fs.writeBlockTrailer(mb)
+	}
+	fs.mu.Unlock()
+
+	blkBufs := make([][]byte, len(blks))
+	idxBufs := make([][]byte, len(blks))
+	for i, mb := range blks {
+		buf, err := readAllFile(mb.mfd)
+		if err != nil {
+			return fmt.Errorf("filestore: could not read block %d for snapshot: %v", mb.index, err)
+		}
+		blkBufs[i] = buf
+
+		buf, err = readAllFile(mb.ifd)
+		if err != nil {
+			return fmt.Errorf("filestore: could not read index %d for snapshot: %v", mb.index, err)
+		}
+		idxBufs[i] = buf
+
+		manifest.Blocks = append(manifest.Blocks, snapshotBlock{
+			Index:   mb.index,
+			BlkName: filepath.ToSlash(filepath.Join(msgDir, fmt.Sprintf(blkScan, mb.index))),
+			BlkSize: int64(len(blkBufs[i])),
+			BlkCRC:  crc32.ChecksumIEEE(blkBufs[i]),
+			IdxName: filepath.ToSlash(filepath.Join(msgDir, fmt.Sprintf(idxScan, mb.index))),
+			IdxSize: int64(len(idxBufs[i])),
+			IdxCRC:  crc32.ChecksumIEEE(idxBufs[i]),
+		})
+	}
+
+	mb, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: snapshotManifestFile, Mode: 0644, Size: int64(len(mb))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(mb); err != nil {
+		return err
+	}
+	for i, b := range manifest.Blocks {
+		if err := tw.WriteHeader(&tar.Header{Name: b.BlkName, Mode: 0644, Size: b.BlkSize}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(blkBufs[i]); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: b.IdxName, Mode: 0644, Size: b.IdxSize}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(idxBufs[i]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// RestoreSnapshot recreates a FileStore under fcfg.StoreDir from a tar
+// stream written by Snapshot. Every block and index entry is validated
+// against the manifest's CRC before anything is installed into StoreDir,
+// so a truncated or bit-rotted snapshot is rejected outright rather than
+// partially unpacked. RestoreSnapshot refuses a StoreDir that already has
+// files in it unless fcfg.Force is set, and otherwise opens the result
+// exactly like newFileStore.
+func RestoreSnapshot(r io.Reader, fcfg FileStoreConfig, cfg MsgSetConfig) (*fileStore, error) {
+	if fcfg.FS == nil {
+		fcfg.FS = newOSFS()
+	}
+	if fi, err := fcfg.FS.Stat(fcfg.StoreDir); err != nil || !fi.IsDir() {
+		return nil, ErrStoreDirMissing
+	}
+	if !fcfg.Force {
+		if fis, err := fcfg.FS.Readdir(fcfg.StoreDir); err == nil && len(fis) > 0 {
+			return nil, ErrStoreDirNotEmpty
+		}
+	}
+
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != snapshotManifestFile {
+		return nil, ErrSnapshotManifest
+	}
+	mb, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, ErrSnapshotManifest
+	}
+	var manifest snapshotManifest
+	if err := json.Unmarshal(mb, &manifest); err != nil || manifest.Version != snapshotVersion {
+		return nil, ErrSnapshotManifest
+	}
+
+	wantByName := make(map[string]snapshotBlock, 2*len(manifest.Blocks))
+	for _, b := range manifest.Blocks {
+		wantByName[b.BlkName] = b
+		wantByName[b.IdxName] = b
+	}
+
+	files := make(map[string][]byte, len(wantByName))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("filestore: could not read snapshot: %v", err)
+		}
+		want, ok := wantByName[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("filestore: snapshot entry %q is not listed in the manifest", hdr.Name)
+		}
+		buf, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("filestore: could not read snapshot entry %q: %v", hdr.Name, err)
+		}
+		wantSize, wantCRC := want.BlkSize, want.BlkCRC
+		if hdr.Name == want.IdxName {
+			wantSize, wantCRC = want.IdxSize, want.IdxCRC
+		}
+		if int64(len(buf)) != wantSize || crc32.ChecksumIEEE(buf) != wantCRC {
+			return nil, ErrSnapshotCorrupt
+		}
+		files[hdr.Name] = buf
+	}
+	for _, b := range manifest.Blocks {
+		if _, ok := files[b.BlkName]; !ok {
+			return nil, fmt.Errorf("filestore: snapshot is missing block file %q", b.BlkName)
+		}
+		if _, ok := files[b.IdxName]; !ok {
+			return nil, fmt.Errorf("filestore: snapshot is missing index file %q", b.IdxName)
+		}
+	}
+
+	// Every entry validated against the manifest - safe to install.
+	mdir := filepath.Join(fcfg.StoreDir, msgDir)
+	if err := fcfg.FS.MkdirAll(mdir, 0755); err != nil {
+		return nil, fmt.Errorf("filestore: could not create msgs directory: %v", err)
+	}
+	for name, buf := range files {
+		f, err := fcfg.FS.Create(filepath.Join(fcfg.StoreDir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, fmt.Errorf("filestore: could not install snapshot entry %q: %v", name, err)
+		}
+		_, werr := f.Write(buf)
+		if cerr := f.Close(); werr == nil {
+			werr = cerr
+		}
+		if werr != nil {
+			return nil, fmt.Errorf("filestore: could not install snapshot entry %q: %v", name, werr)
+		}
+	}
+
+	meta := storeMeta{First: manifest.First, Last: manifest.Last}
+	metaBuf, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fcfg.FS.Create(filepath.Join(fcfg.StoreDir, storeMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	_, werr := f.Write(metaBuf)
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		return nil, werr
+	}
+
+	if fcfg.BlockSize == 0 {
+		fcfg.BlockSize = manifest.BlockSize
+	}
+	fs, _, err := newFileStore(fcfg, cfg)
+	return fs, err
+}
@@ -14,8 +14,10 @@
 package server
 
 import (
+	"archive/tar"
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/bits"
 	"math/rand"
@@ -23,61 +25,99 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestFileStoreBasics(t *testing.T) {
-	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+// fsBackends is the subtest matrix most FileStore tests are run against: the
+// real OS filesystem, and an in-memory VFS. Tests that reach around the VFS
+// abstraction to inspect raw bytes on disk (e.g. bit-rot/erase tests) stay
+// OS-only, since that is what they are specifically exercising.
+var fsBackends = []struct {
+	name string
+	fs   func() VFS
+}{
+	{"OS", func() VFS { return newOSFS() }},
+	{"Mem", func() VFS { return newMemFS() }},
+}
+
+// runFSMatrix runs fn once per backend in fsBackends, handing it a
+// FileStoreConfig with a ready (but empty) StoreDir for that backend.
+func runFSMatrix(t *testing.T, fn func(t *testing.T, fcfg FileStoreConfig)) {
+	t.Helper()
+	for _, b := range fsBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			fcfg := FileStoreConfig{FS: b.fs()}
+			if b.name == "OS" {
+				dir, err := ioutil.TempDir("", JetStreamStoreDir)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				defer os.RemoveAll(dir)
+				fcfg.StoreDir = dir
+			} else {
+				fcfg.StoreDir = "/store"
+				fcfg.FS.MkdirAll(fcfg.StoreDir, 0755)
+			}
+			fn(t, fcfg)
+		})
 	}
-	defer ms.Stop()
+}
 
-	subj, msg := "foo", []byte("Hello World")
-	for i := 1; i <= 5; i++ {
-		if seq, err := ms.StoreMsg(subj, msg); err != nil {
-			t.Fatalf("Error storing msg: %v", err)
-		} else if seq != uint64(i) {
-			t.Fatalf("Expected sequence to be %d, got %d", i, seq)
+func TestFileStoreBasics(t *testing.T) {
+	runFSMatrix(t, func(t *testing.T, fcfg FileStoreConfig) {
+		ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
 		}
-	}
-	stats := ms.Stats()
-	if stats.Msgs != 5 {
-		t.Fatalf("Expected 5 msgs, got %d", stats.Msgs)
-	}
-	expectedSize := 5 * fileStoreMsgSize(subj, msg)
-	if stats.Bytes != expectedSize {
-		t.Fatalf("Expected %d bytes, got %d", expectedSize, stats.Bytes)
-	}
-	nsubj, nmsg, _, err := ms.Lookup(2)
-	if err != nil {
-		t.Fatalf("Unexpected error looking up msg: %v", err)
-	}
-	if nsubj != subj {
-		t.Fatalf("Subjects don't match, original %q vs %q", subj, nsubj)
-	}
-	if !bytes.Equal(nmsg, msg) {
-		t.Fatalf("Msgs don't match, original %q vs %q", msg, nmsg)
-	}
-	_, _, _, err = ms.Lookup(3)
-	if err != nil {
-		t.Fatalf("Unexpected error looking up msg: %v", err)
-	}
+		defer ms.Stop()
+
+		subj, msg := "foo", []byte("Hello World")
+		for i := 1; i <= 5; i++ {
+			if seq, err := ms.StoreMsg(subj, msg); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			} else if seq != uint64(i) {
+				t.Fatalf("Expected sequence to be %d, got %d", i, seq)
+			}
+		}
+		stats := ms.Stats()
+		if stats.Msgs != 5 {
+			t.Fatalf("Expected 5 msgs, got %d", stats.Msgs)
+		}
+		expectedSize := 5 * fileStoreMsgSize(subj, msg)
+		if stats.Bytes != expectedSize {
+			t.Fatalf("Expected %d bytes, got %d", expectedSize, stats.Bytes)
+		}
+		nsubj, nmsg, _, err := ms.Lookup(2)
+		if err != nil {
+			t.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+		if nsubj != subj {
+			t.Fatalf("Subjects don't match, original %q vs %q", subj, nsubj)
+		}
+		if !bytes.Equal(nmsg, msg) {
+			t.Fatalf("Msgs don't match, original %q vs %q", msg, nmsg)
+		}
+		_, _, _, err = ms.Lookup(3)
+		if err != nil {
+			t.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+	})
 }
 
 func TestFileStoreBasicWriteMsgsAndRestore(t *testing.T) {
 	storeDir := filepath.Join("", JetStreamStoreDir)
 	fcfg := FileStoreConfig{StoreDir: storeDir}
 
-	if _, err := newFileStore(fcfg, MsgSetConfig{Storage: MemoryStorage}); err == nil {
+	if _, _, err := newFileStore(fcfg, MsgSetConfig{Storage: MemoryStorage}); err == nil {
 		t.Fatalf("Expected an error with wrong type")
 	}
-	if _, err := newFileStore(fcfg, MsgSetConfig{Storage: FileStorage}); err == nil {
+	if _, _, err := newFileStore(fcfg, MsgSetConfig{Storage: FileStorage}); err == nil {
 		t.Fatalf("Expected an error with no name")
 	}
-	if _, err := newFileStore(fcfg, MsgSetConfig{Name: "dlc", Storage: FileStorage}); err == nil {
+	if _, _, err := newFileStore(fcfg, MsgSetConfig{Name: "dlc", Storage: FileStorage}); err == nil {
 		t.Fatalf("Expected an error with non-existent directory")
 	}
 
@@ -85,7 +125,7 @@ func TestFileStoreBasicWriteMsgsAndRestore(t *testing.T) {
 	os.MkdirAll(storeDir, 0755)
 	defer os.RemoveAll(storeDir)
 
-	ms, err := newFileStore(fcfg, MsgSetConfig{Name: "dlc", Storage: FileStorage})
+	ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "dlc", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -117,7 +157,7 @@ func TestFileStoreBasicWriteMsgsAndRestore(t *testing.T) {
 	// Stop will flush to disk.
 	ms.Stop()
 
-	ms, err = newFileStore(fcfg, MsgSetConfig{Name: "dlc", Storage: FileStorage})
+	ms, _, err = newFileStore(fcfg, MsgSetConfig{Name: "dlc", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -133,41 +173,39 @@ func TestFileStoreBasicWriteMsgsAndRestore(t *testing.T) {
 }
 
 func TestFileStoreMsgLimit(t *testing.T) {
-	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
-	os.MkdirAll(storeDir, 0755)
-	defer os.RemoveAll(storeDir)
-
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxMsgs: 10})
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	defer ms.Stop()
+	runFSMatrix(t, func(t *testing.T, fcfg FileStoreConfig) {
+		ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxMsgs: 10})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer ms.Stop()
 
-	subj, msg := "foo", []byte("Hello World")
-	for i := 0; i < 10; i++ {
-		ms.StoreMsg(subj, msg)
-	}
-	stats := ms.Stats()
-	if stats.Msgs != 10 {
-		t.Fatalf("Expected %d msgs, got %d", 10, stats.Msgs)
-	}
-	if _, err := ms.StoreMsg(subj, msg); err != nil {
-		t.Fatalf("Error storing msg: %v", err)
-	}
-	stats = ms.Stats()
-	if stats.Msgs != 10 {
-		t.Fatalf("Expected %d msgs, got %d", 10, stats.Msgs)
-	}
-	if stats.LastSeq != 11 {
-		t.Fatalf("Expected the last sequence to be 11 now, but got %d", stats.LastSeq)
-	}
-	if stats.FirstSeq != 2 {
-		t.Fatalf("Expected the first sequence to be 2 now, but got %d", stats.FirstSeq)
-	}
-	// Make sure we can not lookup seq 1.
-	if _, _, _, err := ms.Lookup(1); err == nil {
-		t.Fatalf("Expected error looking up seq 1 but got none")
-	}
+		subj, msg := "foo", []byte("Hello World")
+		for i := 0; i < 10; i++ {
+			ms.StoreMsg(subj, msg)
+		}
+		stats := ms.Stats()
+		if stats.Msgs != 10 {
+			t.Fatalf("Expected %d msgs, got %d", 10, stats.Msgs)
+		}
+		if _, err := ms.StoreMsg(subj, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+		stats = ms.Stats()
+		if stats.Msgs != 10 {
+			t.Fatalf("Expected %d msgs, got %d", 10, stats.Msgs)
+		}
+		if stats.LastSeq != 11 {
+			t.Fatalf("Expected the last sequence to be 11 now, but got %d", stats.LastSeq)
+		}
+		if stats.FirstSeq != 2 {
+			t.Fatalf("Expected the first sequence to be 2 now, but got %d", stats.FirstSeq)
+		}
+		// Make sure we can not lookup seq 1.
+		if _, _, _, err := ms.Lookup(1); err == nil {
+			t.Fatalf("Expected error looking up seq 1 but got none")
+		}
+	})
 }
 
 func TestFileStoreBytesLimit(t *testing.T) {
@@ -177,95 +215,91 @@ func TestFileStoreBytesLimit(t *testing.T) {
 	toStore := uint64(1024)
 	maxBytes := storedMsgSize * toStore
 
-	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
-	os.MkdirAll(storeDir, 0755)
-	defer os.RemoveAll(storeDir)
-
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxBytes: int64(maxBytes)})
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	defer ms.Stop()
+	runFSMatrix(t, func(t *testing.T, fcfg FileStoreConfig) {
+		ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxBytes: int64(maxBytes)})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer ms.Stop()
 
-	for i := uint64(0); i < toStore; i++ {
-		ms.StoreMsg(subj, msg)
-	}
-	stats := ms.Stats()
-	if stats.Msgs != toStore {
-		t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
-	}
-	if stats.Bytes != storedMsgSize*toStore {
-		t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, stats.Bytes)
-	}
+		for i := uint64(0); i < toStore; i++ {
+			ms.StoreMsg(subj, msg)
+		}
+		stats := ms.Stats()
+		if stats.Msgs != toStore {
+			t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
+		}
+		if stats.Bytes != storedMsgSize*toStore {
+			t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, stats.Bytes)
+		}
 
-	// Now send 10 more and check that bytes limit enforced.
-	for i := 0; i < 10; i++ {
-		if _, err := ms.StoreMsg(subj, msg); err != nil {
-			t.Fatalf("Error storing msg: %v", err)
+		// Now send 10 more and check that bytes limit enforced.
+		for i := 0; i < 10; i++ {
+			if _, err := ms.StoreMsg(subj, msg); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
 		}
-	}
-	stats = ms.Stats()
-	if stats.Msgs != toStore {
-		t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
-	}
-	if stats.Bytes != storedMsgSize*toStore {
-		t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, stats.Bytes)
-	}
-	if stats.FirstSeq != 11 {
-		t.Fatalf("Expected first sequence to be 11, got %d", stats.FirstSeq)
-	}
-	if stats.LastSeq != toStore+10 {
-		t.Fatalf("Expected last sequence to be %d, got %d", toStore+10, stats.LastSeq)
-	}
+		stats = ms.Stats()
+		if stats.Msgs != toStore {
+			t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
+		}
+		if stats.Bytes != storedMsgSize*toStore {
+			t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, stats.Bytes)
+		}
+		if stats.FirstSeq != 11 {
+			t.Fatalf("Expected first sequence to be 11, got %d", stats.FirstSeq)
+		}
+		if stats.LastSeq != toStore+10 {
+			t.Fatalf("Expected last sequence to be %d, got %d", toStore+10, stats.LastSeq)
+		}
+	})
 }
 
 func TestFileStoreAgeLimit(t *testing.T) {
 	maxAge := 10 * time.Millisecond
 
-	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
-	os.MkdirAll(storeDir, 0755)
-	defer os.RemoveAll(storeDir)
-
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxAge: maxAge})
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	defer ms.Stop()
+	runFSMatrix(t, func(t *testing.T, fcfg FileStoreConfig) {
+		ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxAge: maxAge})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer ms.Stop()
 
-	// Store some messages. Does not really matter how many.
-	subj, msg := "foo", []byte("Hello World")
-	toStore := 100
-	for i := 0; i < toStore; i++ {
-		ms.StoreMsg(subj, msg)
-	}
-	stats := ms.Stats()
-	if stats.Msgs != uint64(toStore) {
-		t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
-	}
-	checkExpired := func(t *testing.T) {
-		t.Helper()
-		checkFor(t, time.Second, maxAge, func() error {
-			stats = ms.Stats()
-			if stats.Msgs != 0 {
-				return fmt.Errorf("Expected no msgs, got %d", stats.Msgs)
-			}
-			if stats.Bytes != 0 {
-				return fmt.Errorf("Expected no bytes, got %d", stats.Bytes)
-			}
-			return nil
-		})
-	}
-	// Let them expire
-	checkExpired(t)
-	// Now add some more and make sure that timer will fire again.
-	for i := 0; i < toStore; i++ {
-		ms.StoreMsg(subj, msg)
-	}
-	stats = ms.Stats()
-	if stats.Msgs != uint64(toStore) {
-		t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
-	}
-	checkExpired(t)
+		// Store some messages. Does not really matter how many.
+		subj, msg := "foo", []byte("Hello World")
+		toStore := 100
+		for i := 0; i < toStore; i++ {
+			ms.StoreMsg(subj, msg)
+		}
+		stats := ms.Stats()
+		if stats.Msgs != uint64(toStore) {
+			t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
+		}
+		checkExpired := func(t *testing.T) {
+			t.Helper()
+			checkFor(t, time.Second, maxAge, func() error {
+				stats = ms.Stats()
+				if stats.Msgs != 0 {
+					return fmt.Errorf("Expected no msgs, got %d", stats.Msgs)
+				}
+				if stats.Bytes != 0 {
+					return fmt.Errorf("Expected no bytes, got %d", stats.Bytes)
+				}
+				return nil
+			})
+		}
+		// Let them expire
+		checkExpired(t)
+		// Now add some more and make sure that timer will fire again.
+		for i := 0; i < toStore; i++ {
+			ms.StoreMsg(subj, msg)
+		}
+		stats = ms.Stats()
+		if stats.Msgs != uint64(toStore) {
+			t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
+		}
+		checkExpired(t)
+	})
 }
 
 func TestFileStoreTimeStamps(t *testing.T) {
@@ -273,7 +307,7 @@ func TestFileStoreTimeStamps(t *testing.T) {
 	os.MkdirAll(storeDir, 0755)
 	defer os.RemoveAll(storeDir)
 
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+	ms, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -299,73 +333,72 @@ func TestFileStoreTimeStamps(t *testing.T) {
 }
 
 func TestFileStorePurge(t *testing.T) {
-	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
-	os.MkdirAll(storeDir, 0755)
-	defer os.RemoveAll(storeDir)
-
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir, BlockSize: 64 * 1024}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	defer ms.Stop()
-
-	subj, msg := "foo", make([]byte, 8*1024)
-	storedMsgSize := fileStoreMsgSize(subj, msg)
+	runFSMatrix(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 64 * 1024
+		ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer ms.Stop()
 
-	toStore := uint64(1024)
-	for i := uint64(0); i < toStore; i++ {
-		ms.StoreMsg(subj, msg)
-	}
-	stats := ms.Stats()
-	if stats.Msgs != toStore {
-		t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
-	}
-	if stats.Bytes != storedMsgSize*toStore {
-		t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, stats.Bytes)
-	}
+		subj, msg := "foo", make([]byte, 8*1024)
+		storedMsgSize := fileStoreMsgSize(subj, msg)
 
-	if numBlocks := ms.numMsgBlocks(); numBlocks <= 1 {
-		t.Fatalf("Expected to have more then 1 msg block, got %d", numBlocks)
-	}
+		toStore := uint64(1024)
+		for i := uint64(0); i < toStore; i++ {
+			ms.StoreMsg(subj, msg)
+		}
+		stats := ms.Stats()
+		if stats.Msgs != toStore {
+			t.Fatalf("Expected %d msgs, got %d", toStore, stats.Msgs)
+		}
+		if stats.Bytes != storedMsgSize*toStore {
+			t.Fatalf("Expected bytes to be %d, got %d", storedMsgSize*toStore, stats.Bytes)
+		}
 
-	ms.Purge()
+		if numBlocks := ms.numMsgBlocks(); numBlocks <= 1 {
+			t.Fatalf("Expected to have more then 1 msg block, got %d", numBlocks)
+		}
 
-	if numBlocks := ms.numMsgBlocks(); numBlocks != 1 {
-		t.Fatalf("Expected to have exactly 1 empty msg block, got %d", numBlocks)
-	}
+		ms.Purge()
 
-	checkPurgeStats := func() {
-		t.Helper()
-		stats = ms.Stats()
-		if stats.Msgs != 0 {
-			t.Fatalf("Expected 0 msgs after purge, got %d", stats.Msgs)
+		if numBlocks := ms.numMsgBlocks(); numBlocks != 1 {
+			t.Fatalf("Expected to have exactly 1 empty msg block, got %d", numBlocks)
 		}
-		if stats.Bytes != 0 {
-			t.Fatalf("Expected 0 bytes after purge, got %d", stats.Bytes)
-		}
-		if stats.LastSeq != toStore {
-			t.Fatalf("Expected LastSeq to be %d., got %d", toStore, stats.LastSeq)
-		}
-		if stats.FirstSeq != toStore+1 {
-			t.Fatalf("Expected FirstSeq to be %d., got %d", toStore+1, stats.FirstSeq)
+
+		checkPurgeStats := func() {
+			t.Helper()
+			stats = ms.Stats()
+			if stats.Msgs != 0 {
+				t.Fatalf("Expected 0 msgs after purge, got %d", stats.Msgs)
+			}
+			if stats.Bytes != 0 {
+				t.Fatalf("Expected 0 bytes after purge, got %d", stats.Bytes)
+			}
+			if stats.LastSeq != toStore {
+				t.Fatalf("Expected LastSeq to be %d., got %d", toStore, stats.LastSeq)
+			}
+			if stats.FirstSeq != toStore+1 {
+				t.Fatalf("Expected FirstSeq to be %d., got %d", toStore+1, stats.FirstSeq)
+			}
 		}
-	}
-	checkPurgeStats()
+		checkPurgeStats()
 
-	// Make sure we recover same state.
-	ms.Stop()
+		// Make sure we recover same state.
+		ms.Stop()
 
-	ms, err = newFileStore(FileStoreConfig{StoreDir: storeDir, BlockSize: 64 * 1024}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	defer ms.Stop()
+		ms, _, err = newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer ms.Stop()
 
-	if numBlocks := ms.numMsgBlocks(); numBlocks != 1 {
-		t.Fatalf("Expected to have exactly 1 empty msg block, got %d", numBlocks)
-	}
+		if numBlocks := ms.numMsgBlocks(); numBlocks != 1 {
+			t.Fatalf("Expected to have exactly 1 empty msg block, got %d", numBlocks)
+		}
 
-	checkPurgeStats()
+		checkPurgeStats()
+	})
 }
 
 func TestFileStoreRemovePartialRecovery(t *testing.T) {
@@ -373,7 +406,7 @@ func TestFileStoreRemovePartialRecovery(t *testing.T) {
 	os.MkdirAll(storeDir, 0755)
 	defer os.RemoveAll(storeDir)
 
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+	ms, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -402,7 +435,7 @@ func TestFileStoreRemovePartialRecovery(t *testing.T) {
 	// Make sure we recover same state.
 	ms.Stop()
 
-	ms, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+	ms, _, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -419,7 +452,7 @@ func TestFileStoreRemoveOutOfOrderRecovery(t *testing.T) {
 	os.MkdirAll(storeDir, 0755)
 	defer os.RemoveAll(storeDir)
 
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+	ms, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -459,7 +492,7 @@ func TestFileStoreRemoveOutOfOrderRecovery(t *testing.T) {
 	// Make sure we recover same state.
 	ms.Stop()
 
-	ms, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+	ms, _, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -487,7 +520,7 @@ func TestFileStoreAgeLimitRecovery(t *testing.T) {
 	os.MkdirAll(storeDir, 0755)
 	defer os.RemoveAll(storeDir)
 
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxAge: maxAge})
+	ms, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxAge: maxAge})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -506,7 +539,7 @@ func TestFileStoreAgeLimitRecovery(t *testing.T) {
 	ms.Stop()
 	time.Sleep(2 * maxAge)
 
-	ms, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxAge: maxAge})
+	ms, _, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage, MaxAge: maxAge})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -526,7 +559,7 @@ func TestFileStoreBitRot(t *testing.T) {
 	os.MkdirAll(storeDir, 0755)
 	defer os.RemoveAll(storeDir)
 
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+	ms, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -572,7 +605,7 @@ func TestFileStoreBitRot(t *testing.T) {
 	// Make sure we can restore.
 	ms.Stop()
 
-	ms, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+	ms, _, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -588,7 +621,7 @@ func TestFileStoreEraseMsg(t *testing.T) {
 	os.MkdirAll(storeDir, 0755)
 	defer os.RemoveAll(storeDir)
 
-	ms, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+	ms, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, MsgSetConfig{Name: "zzz", Storage: FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -620,7 +653,7 @@ func TestFileStoreEraseMsg(t *testing.T) {
 	}
 	defer fp.Close()
 	fp.ReadAt(buf, sm.off)
-	nsubj, nmsg, seq, ts, err := msgFromBuf(buf)
+	nsubj, nmsg, seq, ts, _, err := msgFromBuf(buf)
 	if err != nil {
 		t.Fatalf("error reading message from block: %v", err)
 	}
@@ -662,7 +695,7 @@ func TestFileStorePerf(t *testing.T) {
 	defer os.RemoveAll(storeDir)
 	fmt.Printf("StoreDir is %q\n", storeDir)
 
-	ms, err := newFileStore(
+	ms, _, err := newFileStore(
 		FileStoreConfig{StoreDir: storeDir},
 		MsgSetConfig{Name: "zzz", Storage: FileStorage},
 	)
@@ -690,7 +723,7 @@ func TestFileStorePerf(t *testing.T) {
 		FriendlyBytes(int64(toStore*storedMsgSize)),
 	)
 
-	ms, err = newFileStore(
+	ms, _, err = newFileStore(
 		FileStoreConfig{StoreDir: storeDir, BlockSize: 128 * 1024 * 1024},
 		MsgSetConfig{Name: "zzz", Storage: FileStorage},
 	)
@@ -708,4 +741,619 @@ func TestFileStorePerf(t *testing.T) {
 	fmt.Printf("time to read all back messages is %v\n", tt)
 	fmt.Printf("%.0f msgs/sec\n", float64(toStore)/tt.Seconds())
 	fmt.Printf("%s per sec\n", FriendlyBytes(int64(float64(toStore*storedMsgSize)/tt.Seconds())))
-}
\ No newline at end of file
+}
+
+func TestFileStoreReadCache(t *testing.T) {
+	runFSMatrix(t, func(t *testing.T, fcfg FileStoreConfig) {
+		subj, msg := "foo", []byte("Hello World")
+		rl := fileStoreMsgSize(subj, msg)
+
+		// Sized to cover exactly two records per window.
+		fcfg.ReadBufferSize = uint64(2 * rl)
+		ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer ms.Stop()
+
+		for i := 0; i < 10; i++ {
+			if _, err := ms.StoreMsg(subj, msg); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+		}
+
+		// Seq 1 loads a window covering seqs 1-2; seq 2 is then served from
+		// that same window.
+		if _, _, _, err := ms.Lookup(1); err != nil {
+			t.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+		if _, _, _, err := ms.Lookup(2); err != nil {
+			t.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+		stats := ms.Stats()
+		if stats.ReadCacheMisses != 1 {
+			t.Fatalf("Expected 1 cache miss, got %d", stats.ReadCacheMisses)
+		}
+		if stats.ReadCacheHits != 1 {
+			t.Fatalf("Expected 1 cache hit, got %d", stats.ReadCacheHits)
+		}
+
+		// Seq 9 falls outside that window, so it is a miss, and loads a
+		// fresh window covering seqs 9-10.
+		if _, _, _, err := ms.Lookup(9); err != nil {
+			t.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+		if ms.Stats().ReadCacheMisses != 2 {
+			t.Fatalf("Expected 2 cache misses, got %d", ms.Stats().ReadCacheMisses)
+		}
+
+		// Removing seq 10, which the current window covers, invalidates
+		// it, so looking seq 9 back up is a miss rather than a hit.
+		if !ms.RemoveMsg(10) {
+			t.Fatalf("Expected RemoveMsg to succeed")
+		}
+		if _, _, _, err := ms.Lookup(9); err != nil {
+			t.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+		if ms.Stats().ReadCacheMisses != 3 {
+			t.Fatalf("Expected the read window to have been invalidated by the remove, got %d misses", ms.Stats().ReadCacheMisses)
+		}
+	})
+}
+
+func TestFileStoreDedup(t *testing.T) {
+	runFSMatrix(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.Dedup = true
+		ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer ms.Stop()
+
+		subjA, subjB := "foo", "bar"
+		payload := bytes.Repeat([]byte("ZZZZ"), 16) // well over dedupHashSize
+
+		if _, err := ms.StoreMsg(subjA, payload); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+		if stats := ms.Stats(); stats.DedupSavedBytes != 0 {
+			t.Fatalf("Expected no saved bytes on first copy, got %d", stats.DedupSavedBytes)
+		}
+
+		if _, err := ms.StoreMsg(subjB, payload); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+		wantSaved := fileStoreMsgSize(subjB, payload) - uint64(msgHdrSize+msgTrailerLen+len(subjB)+dedupHashSize)
+		if stats := ms.Stats(); stats.DedupSavedBytes != wantSaved {
+			t.Fatalf("Expected %d saved bytes after duplicate, got %d", wantSaved, stats.DedupSavedBytes)
+		}
+
+		// Both messages read back their own subject with the shared payload.
+		nsubj, nmsg, _, err := ms.Lookup(1)
+		if err != nil || nsubj != subjA || !bytes.Equal(nmsg, payload) {
+			t.Fatalf("Unexpected lookup of seq 1: %q %q %v", nsubj, nmsg, err)
+		}
+		nsubj, nmsg, _, err = ms.Lookup(2)
+		if err != nil || nsubj != subjB || !bytes.Equal(nmsg, payload) {
+			t.Fatalf("Unexpected lookup of seq 2: %q %q %v", nsubj, nmsg, err)
+		}
+
+		// Removing the canonical copy (seq 1) must not take the still
+		// referenced payload (seq 2) down with it.
+		if !ms.RemoveMsg(1) {
+			t.Fatalf("Expected RemoveMsg to succeed")
+		}
+		if _, _, _, err := ms.Lookup(1); err == nil {
+			t.Fatalf("Expected seq 1 to be gone")
+		}
+		if _, nmsg, _, err := ms.Lookup(2); err != nil || !bytes.Equal(nmsg, payload) {
+			t.Fatalf("Expected seq 2 to still resolve its payload: %v", err)
+		}
+		if badSeqs := ms.checkMsgs(); len(badSeqs) > 0 {
+			t.Fatalf("Expected no corrupt msgs, got %v", badSeqs)
+		}
+	})
+}
+
+// flipABit reverses one byte somewhere in buf and returns its index, the
+// same approach TestFileStoreBitRot uses to simulate bit-rot.
+func flipABit(buf []byte) int {
+	var index int
+	for {
+		index = rand.Intn(len(buf))
+		b := buf[index]
+		buf[index] = bits.Reverse8(b)
+		if b != buf[index] {
+			break
+		}
+	}
+	return index
+}
+
+// freshFSDir returns a StoreDir under fcfg's backend that sub does not
+// share with any other caller, so parallel Repair scenarios within the
+// same backend don't trip over each other's on disk state.
+func freshFSDir(t *testing.T, fcfg FileStoreConfig, sub string) string {
+	t.Helper()
+	if _, ok := fcfg.FS.(osFS); ok {
+		dir, err := ioutil.TempDir("", JetStreamStoreDir)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return dir
+	}
+	dir := "/" + sub
+	fcfg.FS.MkdirAll(dir, 0755)
+	return dir
+}
+
+func TestFileStoreRepair(t *testing.T) {
+	runFSMatrix(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 1024
+
+		// storeAndCorrupt builds a store with several blocks and flips a
+		// bit in the first (i.e. not the last/active) block, so Repair is
+		// exercised against an arbitrary block rather than just ms.lmb.
+		storeAndCorrupt := func(fcfg FileStoreConfig) (*fileStore, *msgBlock) {
+			ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			subj, msg := "foo", []byte("Hello World")
+			for i := 0; i < 100; i++ {
+				if _, err := ms.StoreMsg(subj, msg); err != nil {
+					t.Fatalf("Error storing msg: %v", err)
+				}
+			}
+			ms.mu.Lock()
+			if len(ms.blks) < 2 {
+				ms.mu.Unlock()
+				t.Fatalf("Expected more than 1 msg block, got %d", len(ms.blks))
+			}
+			mb := ms.blks[0]
+			buf, err := readAllFile(mb.mfd)
+			if err != nil {
+				t.Fatalf("Error reading block: %v", err)
+			}
+			flipABit(buf)
+			if _, err := mb.mfd.WriteAt(buf, 0); err != nil {
+				t.Fatalf("Error writing corrupted block: %v", err)
+			}
+			ms.mu.Unlock()
+			return ms, mb
+		}
+
+		t.Run("Quarantine", func(t *testing.T) {
+			qfcfg := fcfg
+			qfcfg.StoreDir = freshFSDir(t, fcfg, "quarantine")
+			ms, _ := storeAndCorrupt(qfcfg)
+			defer ms.Stop()
+			if badSeqs := ms.checkMsgs(); len(badSeqs) == 0 {
+				t.Fatalf("Expected to have corrupt msgs")
+			}
+			before := ms.numMsgBlocks()
+			dropped, err := ms.Repair(RepairQuarantine)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(dropped) == 0 {
+				t.Fatalf("Expected Repair to quarantine at least one msg")
+			}
+			if badSeqs := ms.checkMsgs(); len(badSeqs) > 0 {
+				t.Fatalf("Expected no more corrupt msgs after repair, got %v", badSeqs)
+			}
+			if ms.numMsgBlocks() != before {
+				t.Fatalf("Expected quarantine to leave block count at %d, got %d", before, ms.numMsgBlocks())
+			}
+		})
+
+		t.Run("Truncate", func(t *testing.T) {
+			tfcfg := fcfg
+			tfcfg.StoreDir = freshFSDir(t, fcfg, "truncate")
+			ms, _ := storeAndCorrupt(tfcfg)
+			defer ms.Stop()
+			before := ms.numMsgBlocks()
+			dropped, err := ms.Repair(RepairTruncate)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(dropped) == 0 {
+				t.Fatalf("Expected Repair to truncate at least one msg")
+			}
+			if badSeqs := ms.checkMsgs(); len(badSeqs) > 0 {
+				t.Fatalf("Expected no more corrupt msgs after repair, got %v", badSeqs)
+			}
+			if ms.numMsgBlocks() != before {
+				t.Fatalf("Expected truncate to leave other blocks in place, got %d blocks, wanted %d", ms.numMsgBlocks(), before)
+			}
+		})
+
+		t.Run("Mirror", func(t *testing.T) {
+			mfcfg := fcfg
+			mfcfg.StoreDir = freshFSDir(t, fcfg, "mirror-primary")
+			mfcfg.MirrorDir = freshFSDir(t, fcfg, "mirror-replica")
+
+			ms, _, err := newFileStore(mfcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer ms.Stop()
+
+			subj, msg := "foo", []byte("Hello World")
+			for i := 0; i < 100; i++ {
+				if _, err := ms.StoreMsg(subj, msg); err != nil {
+					t.Fatalf("Error storing msg: %v", err)
+				}
+			}
+			ms.mu.Lock()
+			if len(ms.blks) < 2 {
+				ms.mu.Unlock()
+				t.Fatalf("Expected more than 1 msg block, got %d", len(ms.blks))
+			}
+			mb := ms.blks[0]
+			good, err := readAllFile(mb.mfd)
+			if err != nil {
+				t.Fatalf("Error reading block: %v", err)
+			}
+
+			// Mirror holds a known-good copy of this block before it gets
+			// corrupted in the primary store.
+			mirrorMsgDir := filepath.Join(mfcfg.MirrorDir, msgDir)
+			mfcfg.FS.MkdirAll(mirrorMsgDir, 0755)
+			mf, err := mfcfg.FS.Create(filepath.Join(mirrorMsgDir, fmt.Sprintf(blkScan, mb.index)))
+			if err != nil {
+				t.Fatalf("Error writing mirror block: %v", err)
+			}
+			mf.WriteAt(good, 0)
+			mf.Close()
+
+			corrupt := append([]byte(nil), good...)
+			index := flipABit(corrupt)
+			if _, err := mb.mfd.WriteAt(corrupt, 0); err != nil {
+				t.Fatalf("Error writing corrupted block: %v", err)
+			}
+			ms.mu.Unlock()
+
+			if badSeqs := ms.checkMsgs(); len(badSeqs) == 0 {
+				t.Fatalf("Expected to have corrupt msgs: changed [%d]", index)
+			}
+			dropped, err := ms.Repair(RepairMirror)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(dropped) != 0 {
+				t.Fatalf("Expected Mirror repair to heal instead of dropping, got %v", dropped)
+			}
+			if badSeqs := ms.checkMsgs(); len(badSeqs) > 0 {
+				t.Fatalf("Expected no more corrupt msgs after mirror repair, got %v", badSeqs)
+			}
+		})
+
+		t.Run("AutoRepairOnUncleanShutdown", func(t *testing.T) {
+			afcfg := fcfg
+			afcfg.StoreDir = freshFSDir(t, fcfg, "auto-repair")
+			// Simulate a crash: skip Stop so the dirty marker is left behind.
+			storeAndCorrupt(afcfg)
+
+			ms2, report, err := newFileStore(afcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer ms2.Stop()
+
+			if !report.Ran {
+				t.Fatalf("Expected RecoveryReport to indicate a repair ran")
+			}
+			if len(report.Dropped) == 0 {
+				t.Fatalf("Expected RecoveryReport to list at least one dropped msg")
+			}
+			if badSeqs := ms2.checkMsgs(); len(badSeqs) > 0 {
+				t.Fatalf("Expected no corrupt msgs after auto-repair, got %v", badSeqs)
+			}
+		})
+
+		t.Run("QuarantinePreservesSharedDedupPayload", func(t *testing.T) {
+			qfcfg := fcfg
+			qfcfg.StoreDir = freshFSDir(t, fcfg, "quarantine-dedup")
+			qfcfg.Dedup = true
+			ms, _, err := newFileStore(qfcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer ms.Stop()
+
+			subj, payload := "canon", bytes.Repeat([]byte("Q"), 64)
+			if _, err := ms.StoreMsg(subj, payload); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+			if _, err := ms.StoreMsg("ref", payload); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+
+			// Corrupt a byte inside seq 1's subject, not its payload - the
+			// record as a whole still fails verification, but the payload
+			// bytes seq 2 resolves through by hash remain intact. Quarantining
+			// seq 1 must not take that untouched, live message down with it.
+			ms.mu.Lock()
+			mb, mi := ms.blockAndEntry(1)
+			buf, err := readAllFile(mb.mfd)
+			if err != nil {
+				t.Fatalf("Error reading block: %v", err)
+			}
+			subjOff := mi.off + int64(msgHdrSize)
+			flipABit(buf[subjOff : subjOff+int64(len(subj))])
+			if _, err := mb.mfd.WriteAt(buf, 0); err != nil {
+				t.Fatalf("Error writing corrupted block: %v", err)
+			}
+			ms.mu.Unlock()
+
+			if badSeqs := ms.checkMsgs(); len(badSeqs) == 0 {
+				t.Fatalf("Expected to have corrupt msgs")
+			}
+			dropped, err := ms.Repair(RepairQuarantine)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(dropped) == 0 {
+				t.Fatalf("Expected Repair to quarantine at least one msg")
+			}
+			if _, nmsg, _, err := ms.Lookup(2); err != nil || !bytes.Equal(nmsg, payload) {
+				t.Fatalf("Expected seq 2's shared payload to survive quarantine of seq 1: %q %v", nmsg, err)
+			}
+		})
+
+		t.Run("TruncateDoesNotDoubleDecrementDedupRefs", func(t *testing.T) {
+			tfcfg := fcfg
+			tfcfg.StoreDir = freshFSDir(t, fcfg, "truncate-dedup")
+			tfcfg.Dedup = true
+			tfcfg.BlockSize = 210
+			ms, _, err := newFileStore(tfcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer ms.Stop()
+
+			payload := bytes.Repeat([]byte("Q"), 64)
+			// seq 1 (canonical) and seq 3 (a dedup ref) both land in the
+			// first block alongside seq 2, the record that gets corrupted
+			// below; seq 4, another dedup ref to the same payload, is
+			// pushed into a second block by BlockSize. Removing seq 1 and
+			// seq 3 leaves seq 4 as the payload's sole live reference.
+			if _, err := ms.StoreMsg("canon", payload); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+			if _, err := ms.StoreMsg("corrupt", []byte("Hello World!")); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+			if _, err := ms.StoreMsg("ref1", payload); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+			if _, err := ms.StoreMsg("ref2", payload); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+
+			if !ms.RemoveMsg(1) {
+				t.Fatalf("Expected to remove seq 1")
+			}
+			if !ms.RemoveMsg(3) {
+				t.Fatalf("Expected to remove seq 3")
+			}
+
+			ms.mu.Lock()
+			mb, mi := ms.blockAndEntry(2)
+			buf, err := readAllFile(mb.mfd)
+			if err != nil {
+				t.Fatalf("Error reading block: %v", err)
+			}
+			flipABit(buf[mi.off : mi.off+int64(mi.rl)])
+			if _, err := mb.mfd.WriteAt(buf, 0); err != nil {
+				t.Fatalf("Error writing corrupted block: %v", err)
+			}
+			ms.mu.Unlock()
+
+			if _, err := ms.Repair(RepairTruncate); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, nmsg, _, err := ms.Lookup(4); err != nil || !bytes.Equal(nmsg, payload) {
+				t.Fatalf("Expected seq 4's shared payload to survive truncation of the already-removed seq 1 and seq 3: %q %v", nmsg, err)
+			}
+		})
+
+		t.Run("TruncateRelocatesSharedDedupPayloadPastCutPoint", func(t *testing.T) {
+			rfcfg := fcfg
+			rfcfg.StoreDir = freshFSDir(t, fcfg, "truncate-relocate-dedup")
+			rfcfg.Dedup = true
+			rfcfg.BlockSize = 150
+			ms, _, err := newFileStore(rfcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer ms.Stop()
+
+			payload := bytes.Repeat([]byte("Q"), 64)
+			// seq 1 is corrupted below; seq 2, the canonical copy, sits
+			// right after it in the same block - on or after the cut
+			// point truncation applies - while seq 3's dedup ref to the
+			// same payload lands in a second block by BlockSize. Unlike
+			// TruncateDoesNotDoubleDecrementDedupRefs, the canonical copy
+			// here is still live and in the truncated range, so it must
+			// be relocated rather than just dereferenced.
+			if _, err := ms.StoreMsg("filler", []byte("Hello World!")); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+			if _, err := ms.StoreMsg("canon", payload); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+			if _, err := ms.StoreMsg("ref1", payload); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+
+			ms.mu.Lock()
+			mb, mi := ms.blockAndEntry(1)
+			buf, err := readAllFile(mb.mfd)
+			if err != nil {
+				t.Fatalf("Error reading block: %v", err)
+			}
+			flipABit(buf[mi.off : mi.off+int64(mi.rl)])
+			if _, err := mb.mfd.WriteAt(buf, 0); err != nil {
+				t.Fatalf("Error writing corrupted block: %v", err)
+			}
+			ms.mu.Unlock()
+
+			dropped, err := ms.Repair(RepairTruncate)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(dropped) == 0 {
+				t.Fatalf("Expected Repair to truncate at least one msg")
+			}
+			if _, nmsg, _, err := ms.Lookup(3); err != nil || !bytes.Equal(nmsg, payload) {
+				t.Fatalf("Expected seq 3's shared payload to survive truncation of seq 1 and seq 2: %q %v", nmsg, err)
+			}
+		})
+	})
+}
+
+func TestFileStoreSnapshotRestore(t *testing.T) {
+	runFSMatrix(t, func(t *testing.T, fcfg FileStoreConfig) {
+		fcfg.BlockSize = 1024
+
+		ms, _, err := newFileStore(fcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		subj, msg := "foo", []byte("Hello World")
+		for i := 0; i < 100; i++ {
+			if _, err := ms.StoreMsg(subj, msg); err != nil {
+				t.Fatalf("Error storing msg: %v", err)
+			}
+		}
+		if ms.numMsgBlocks() < 2 {
+			t.Fatalf("Expected more than 1 msg block, got %d", ms.numMsgBlocks())
+		}
+		ms.RemoveMsg(1)
+
+		var snap bytes.Buffer
+		if err := ms.Snapshot(&snap); err != nil {
+			t.Fatalf("Unexpected error taking snapshot: %v", err)
+		}
+		wantStats := ms.Stats()
+		ms.Stop()
+
+		t.Run("Restore", func(t *testing.T) {
+			rfcfg := fcfg
+			rfcfg.StoreDir = freshFSDir(t, fcfg, "restore")
+			rs, err := RestoreSnapshot(bytes.NewReader(snap.Bytes()), rfcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error restoring snapshot: %v", err)
+			}
+			defer rs.Stop()
+
+			if stats := rs.Stats(); !reflect.DeepEqual(stats, wantStats) {
+				t.Fatalf("Expected restored stats %+v, got %+v", wantStats, stats)
+			}
+			nsubj, nmsg, _, err := rs.Lookup(2)
+			if err != nil || nsubj != subj || !bytes.Equal(nmsg, msg) {
+				t.Fatalf("Unexpected lookup of seq 2 after restore: %q %q %v", nsubj, nmsg, err)
+			}
+			if _, _, _, err := rs.Lookup(1); err == nil {
+				t.Fatalf("Expected seq 1 to still be gone after restore")
+			}
+		})
+
+		t.Run("RefusesNonEmptyDirWithoutForce", func(t *testing.T) {
+			nfcfg := fcfg
+			nfcfg.StoreDir = freshFSDir(t, fcfg, "non-empty")
+			busy, _, err := newFileStore(nfcfg, MsgSetConfig{Name: "busy", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			busy.Stop()
+
+			if _, err := RestoreSnapshot(bytes.NewReader(snap.Bytes()), nfcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage}); err != ErrStoreDirNotEmpty {
+				t.Fatalf("Expected ErrStoreDirNotEmpty, got %v", err)
+			}
+
+			nfcfg.Force = true
+			rs, err := RestoreSnapshot(bytes.NewReader(snap.Bytes()), nfcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error restoring with Force: %v", err)
+			}
+			defer rs.Stop()
+		})
+
+		t.Run("DetectsCorruption", func(t *testing.T) {
+			// Re-tar the snapshot, flipping a bit in the first block's
+			// payload so the manifest CRC no longer matches it.
+			var corrupt bytes.Buffer
+			tr := tar.NewReader(bytes.NewReader(snap.Bytes()))
+			tw := tar.NewWriter(&corrupt)
+			flipped := false
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Unexpected error reading snapshot: %v", err)
+				}
+				buf, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("Unexpected error reading snapshot entry: %v", err)
+				}
+				if !flipped && strings.HasSuffix(hdr.Name, ".blk") {
+					flipABit(buf)
+					flipped = true
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatalf("Unexpected error re-writing snapshot header: %v", err)
+				}
+				if _, err := tw.Write(buf); err != nil {
+					t.Fatalf("Unexpected error re-writing snapshot entry: %v", err)
+				}
+			}
+			tw.Close()
+			if !flipped {
+				t.Fatalf("Expected to find a block file to corrupt")
+			}
+
+			cfcfg := fcfg
+			cfcfg.StoreDir = freshFSDir(t, fcfg, "corrupt")
+			if _, err := RestoreSnapshot(bytes.NewReader(corrupt.Bytes()), cfcfg, MsgSetConfig{Name: "zzz", Storage: FileStorage}); err != ErrSnapshotCorrupt {
+				t.Fatalf("Expected ErrSnapshotCorrupt, got %v", err)
+			}
+		})
+	})
+}
+
+func BenchmarkFileStoreSequentialLookup(b *testing.B) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	ms, _, err := newFileStore(
+		FileStoreConfig{StoreDir: storeDir, ReadBufferSize: 1024 * 1024},
+		MsgSetConfig{Name: "zzz", Storage: FileStorage},
+	)
+	if err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+	defer ms.Stop()
+
+	subj, msg := "foo", make([]byte, 256)
+	const n = 50000
+	for i := 0; i < n; i++ {
+		if _, err := ms.StoreMsg(subj, msg); err != nil {
+			b.Fatalf("Error storing msg: %v", err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		seq := uint64(i%n) + 1
+		if _, _, _, err := ms.Lookup(seq); err != nil {
+			b.Fatalf("Unexpected error looking up msg: %v", err)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// VFS is the filesystem abstraction FileStore uses for every on disk
+// operation, modeled on afero.Fs. Swapping the FS field of FileStoreConfig
+// lets callers back a store with something other than the real OS
+// filesystem - an in memory store for fast tests, an object-storage backed
+// store, an encrypted overlay - without forking the file store logic.
+type VFS interface {
+	Create(name string) (File, error)
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldname, newname string) error
+	Readdir(dirname string) ([]os.FileInfo, error)
+}
+
+// File is the subset of *os.File operations FileStore relies on.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	ReadAt(b []byte, off int64) (int, error)
+	WriteAt(b []byte, off int64) (int, error)
+	Truncate(size int64) error
+	Sync() error
+	Name() string
+}
+
+// osFS is the default, real filesystem backed VFS implementation.
+type osFS struct{}
+
+// newOSFS returns a VFS backed by the real operating system filesystem.
+func newOSFS() VFS { return osFS{} }
+
+func (osFS) Create(name string) (File, error) { return os.Create(name) }
+func (osFS) Open(name string) (File, error)   { return os.Open(name) }
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+func (osFS) Mkdir(name string, perm os.FileMode) error    { return os.Mkdir(name, perm) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+func (osFS) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+
+func (osFS) Readdir(dirname string) ([]os.FileInfo, error) {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+// memFS is an in memory VFS implementation, useful for fast unit tests and
+// as a template for other non-OS backends (object storage, encrypted
+// overlays, etc).
+type memFS struct {
+	mu    sync.Mutex
+	dirs  map[string]bool
+	files map[string]*memFile
+}
+
+// newMemFS returns a VFS that keeps all files in memory.
+func newMemFS() VFS {
+	return &memFS{
+		dirs:  map[string]bool{"/": true, "": true},
+		files: make(map[string]*memFile),
+	}
+}
+
+func memKey(name string) string { return filepath.ToSlash(filepath.Clean(name)) }
+
+func (m *memFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dirs[memKey(name)] = true
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for p := memKey(path); p != "." && p != "/" && p != ""; p = memKey(filepath.Dir(p)) {
+		m.dirs[p] = true
+	}
+	return nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	key := memKey(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs[key] {
+		return memFileInfo{name: filepath.Base(name), isDir: true}, nil
+	}
+	if f, ok := m.files[key]; ok {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return memFileInfo{name: filepath.Base(name), size: int64(len(f.data))}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *memFS) Remove(name string) error {
+	key := memKey(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, key)
+	delete(m.dirs, key)
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	prefix := memKey(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.files {
+		if k == prefix || (len(k) > len(prefix) && k[:len(prefix)+1] == prefix+"/") {
+			delete(m.files, k)
+		}
+	}
+	delete(m.dirs, prefix)
+	return nil
+}
+
+func (m *memFS) Rename(oldname, newname string) error {
+	okey, nkey := memKey(oldname), memKey(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.files[okey]; ok {
+		delete(m.files, okey)
+		f.name = newname
+		m.files[nkey] = f
+		return nil
+	}
+	return os.ErrNotExist
+}
+
+func (m *memFS) Readdir(dirname string) ([]os.FileInfo, error) {
+	prefix := memKey(dirname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var infos []os.FileInfo
+	for k, f := range m.files {
+		dir := filepath.ToSlash(filepath.Dir(k))
+		if dir == prefix {
+			f.mu.Lock()
+			infos = append(infos, memFileInfo{name: filepath.Base(k), size: int64(len(f.data))})
+			f.mu.Unlock()
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *memFS) Create(name string) (File, error) {
+	return m.open(name, true)
+}
+
+func (m *memFS) Open(name string) (File, error) {
+	m.mu.Lock()
+	_, ok := m.files[memKey(name)]
+	m.mu.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return m.open(name, false)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	_, exists := m.files[memKey(name)]
+	m.mu.Unlock()
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	return m.open(name, flag&os.O_TRUNC != 0)
+}
+
+func (m *memFS) open(name string, truncate bool) (File, error) {
+	key := memKey(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[key]
+	if !ok || truncate {
+		f = &memFile{name: name}
+		m.files[key] = f
+	}
+	return f, nil
+}
+
+// memFile is an in memory File implementation backed by a byte slice.
+type memFile struct {
+	mu     sync.Mutex
+	name   string
+	data   []byte
+	offset int64
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAtLocked(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.writeAtLocked(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAtLocked(p, off)
+}
+
+func (f *memFile) readAtLocked(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	var err error
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAtLocked(p, off)
+}
+
+func (f *memFile) writeAtLocked(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > int64(len(f.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.data)
+		f.data = grown
+	}
+	copy(f.data[off:end], p)
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size]
+		return nil
+	}
+	grown := make([]byte, size)
+	copy(grown, f.data)
+	f.data = grown
+	return nil
+}
+
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
+
+// memFileInfo is a minimal os.FileInfo for entries living in a memFS.
+type memFileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.isDir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
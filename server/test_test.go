@@ -0,0 +1,36 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// checkFor polls fn every interval until it either returns nil or totalWait
+// elapses, at which point the last error is reported as a test failure.
+// Shared by tests that exercise asynchronous behavior (timers, background
+// expiry, etc).
+func checkFor(t *testing.T, totalWait, interval time.Duration, fn func() error) {
+	t.Helper()
+	deadline := time.Now().Add(totalWait)
+	var err error
+	for time.Now().Before(deadline) {
+		if err = fn(); err == nil {
+			return
+		}
+		time.Sleep(interval)
+	}
+	t.Fatalf("%v", err)
+}
@@ -0,0 +1,31 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "fmt"
+
+// FriendlyBytes returns a human readable string for the given size in bytes,
+// e.g. 1024 -> "1.00K".
+func FriendlyBytes(bytes int64) string {
+	const base = 1024.0
+	units := []string{"B", "K", "M", "G", "T", "P", "E"}
+
+	v := float64(bytes)
+	index := 0
+	for v >= base && index < len(units)-1 {
+		v /= base
+		index++
+	}
+	return fmt.Sprintf("%.2f%s", v, units[index])
+}